@@ -0,0 +1,260 @@
+// Command homie discovers, reads, sets, watches and wipes Homie devices on an MQTT broker
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/masgari/homie-go/controller"
+	"github.com/masgari/homie-go/homie"
+)
+
+const usageText = `Usage: homie [flags] <command> [arguments]
+
+Commands:
+  discover                     list all devices under base topic, as a tree or JSON with -json
+  get <device/node/property>   print current value of a property
+  set <device/node/property> <value>
+                               set a property and wait for device to acknowledge it, see -ack
+  watch [device]               print value and state changes with timestamps until interrupted
+  wipe <device>                clear all retained topics of a device, Homie 3/4 and 5 topics are cleared
+                               if device is not discovered
+
+Flags:
+`
+
+var (
+	brokerURL  = flag.String("url", "tcp://localhost:1883", "broker URL with tcp, ssl, tls, ws or wss scheme")
+	brokers    = flag.String("brokers", "", "comma separated broker URLs in failover order, overrides -url")
+	username   = flag.String("username", "", "MQTT username")
+	password   = flag.String("password", "", "MQTT password, defaults to $HOMIE_MQTT_PASSWORD")
+	caFile     = flag.String("ca", "", "PEM CA bundle to verify broker certificate")
+	certFile   = flag.String("cert", "", "PEM client certificate for mutual TLS")
+	keyFile    = flag.String("key", "", "PEM client private key for mutual TLS")
+	serverName = flag.String("server-name", "", "host name used to verify broker certificate")
+	insecure   = flag.Bool("insecure", false, "do not verify broker certificate")
+	baseTopic  = flag.String("base", "homie/", "base topic of devices, must end with '/'")
+	wait       = flag.Duration("wait", 2*time.Second, "time to wait for devices to be discovered")
+	ack        = flag.Duration("ack", 5*time.Second, "time to wait for device to acknowledge a set command, 0 to not wait")
+	jsonOutput = flag.Bool("json", false, "print discover output as JSON")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usageText)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	if err := run(ctx, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "homie:", err)
+		if errors.Is(err, errUsage) {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("invalid arguments")
+
+func run(ctx context.Context, command string, args []string) error {
+	// stop controller when command is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	switch command {
+	case "discover":
+		if len(args) != 0 {
+			return errUsage
+		}
+		c, err := start(ctx, "", nil)
+		if err != nil {
+			return err
+		}
+		return printDevices(os.Stdout, c, *jsonOutput)
+	case "get":
+		if len(args) != 1 {
+			return errUsage
+		}
+		device, node, property, err := parsePath(args[0])
+		if err != nil {
+			return err
+		}
+		c, err := start(ctx, device, nil)
+		if err != nil {
+			return err
+		}
+		p, err := findProperty(c, device, node, property)
+		if err != nil {
+			return err
+		}
+		fmt.Println(p.Value())
+		return nil
+	case "set":
+		if len(args) != 2 {
+			return errUsage
+		}
+		device, node, property, err := parsePath(args[0])
+		if err != nil {
+			return err
+		}
+		c, err := start(ctx, device, nil)
+		if err != nil {
+			return err
+		}
+		return c.SetProperty(ctx, device, node, property, args[1])
+	case "watch":
+		if len(args) > 1 {
+			return errUsage
+		}
+		device := ""
+		if len(args) == 1 {
+			device = args[0]
+		}
+		if _, err := start(ctx, "", printEvent(os.Stdout, device)); err != nil {
+			return err
+		}
+		<-ctx.Done()
+		return nil
+	case "wipe":
+		if len(args) != 1 {
+			return errUsage
+		}
+		c, err := start(ctx, args[0], nil)
+		if errors.Is(err, controller.ErrDeviceNotFound) && c != nil {
+			// device is not announced, for example only stale topics are left
+			return wipeTopics(ctx, c.Client(), args[0])
+		}
+		if err != nil {
+			return err
+		}
+		return c.WipeDevice(ctx, args[0])
+	default:
+		return fmt.Errorf("%w: unknown command %s", errUsage, command)
+	}
+}
+
+// start run a controller in background and wait for discovery, until device is added if it is set,
+// otherwise for -wait duration. The running controller is returned with ErrDeviceNotFound if device is not added
+func start(ctx context.Context, device string, handler controller.EventHandler) (controller.Controller, error) {
+	c, err := controller.New(&controller.Config{
+		Mqtt:       mqttConfig(),
+		BaseTopic:  *baseTopic,
+		AckTimeout: *ack,
+	})
+	if err != nil {
+		return nil, err
+	}
+	added := make(chan struct{})
+	var once sync.Once
+	c.SetEventHandler(func(e controller.Event) {
+		if e.Type == controller.EventDeviceAdded && e.Device.Name() == device {
+			once.Do(func() { close(added) })
+		}
+		if handler != nil {
+			handler(e)
+		}
+	})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Run(ctx)
+	}()
+
+	timeout := time.NewTimer(*wait)
+	defer timeout.Stop()
+	select {
+	case err := <-errs:
+		if err == nil {
+			err = ctx.Err()
+		}
+		return nil, err
+	case <-added:
+	case <-timeout.C:
+		if device != "" {
+			return c, fmt.Errorf("%w: %s", controller.ErrDeviceNotFound, device)
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return c, nil
+}
+
+// wipeTopics clear retained topics of a device which is not discovered, Homie version is not known so
+// topics under both <base>/<device>/ and Homie 5 <base>/5/<device>/ are cleared
+func wipeTopics(ctx context.Context, client homie.MqttAdapter, device string) error {
+	if err := homie.WipeDevice(ctx, client, *baseTopic, device, nil); err != nil {
+		return err
+	}
+	return homie.WipeDevice(ctx, client, *baseTopic, device, &homie.Description{Homie: homie.HomieSpecVersion5})
+}
+
+func mqttConfig() homie.MqttConfig {
+	cfg := homie.MqttConfig{
+		URL:      *brokerURL,
+		Username: *username,
+		Password: *password,
+		TLS: homie.TLSConfig{
+			CAFile:             *caFile,
+			CertFile:           *certFile,
+			KeyFile:            *keyFile,
+			ServerName:         *serverName,
+			InsecureSkipVerify: *insecure,
+		},
+		// fail fast instead of retrying forever
+		Retry: homie.RetryPolicy{MaxAttempts: 1},
+	}
+	if *brokers != "" {
+		cfg.Brokers = strings.Split(*brokers, ",")
+	}
+	// not used as flag default, defaults are printed in usage
+	if cfg.Password == "" {
+		cfg.Password = os.Getenv("HOMIE_MQTT_PASSWORD")
+	}
+	return cfg
+}
+
+// parsePath split a device/node/property path
+func parsePath(path string) (string, string, string, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 {
+		return "", "", "", fmt.Errorf("%w: expected device/node/property, got %s", errUsage, path)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+func findProperty(c controller.Controller, device string, node string, property string) (controller.Property, error) {
+	d := c.GetDevice(device)
+	if d == nil {
+		return nil, fmt.Errorf("%w: %s", controller.ErrDeviceNotFound, device)
+	}
+	n := d.GetNode(node)
+	if n == nil {
+		return nil, fmt.Errorf("%w: %s/%s", homie.ErrNodeNotFound, device, node)
+	}
+	p := n.GetProperty(property)
+	if p == nil {
+		return nil, fmt.Errorf("%w: %s/%s/%s", homie.ErrPropertyNotFound, device, node, property)
+	}
+	return p, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/masgari/homie-go/controller"
+	"github.com/masgari/homie-go/homie"
+	"github.com/masgari/homie-go/internal/mqtttest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordFromEnvironment(t *testing.T) {
+	os.Setenv("HOMIE_MQTT_PASSWORD", "s3cret")
+	defer os.Unsetenv("HOMIE_MQTT_PASSWORD")
+	assert.Equal(t, "s3cret", mqttConfig().Password)
+	assert.Equal(t, "", flag.Lookup("password").DefValue)
+}
+
+func TestCommands(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+	*brokerURL = broker.URL()
+	*wait = time.Second
+
+	d, err := homie.NewDevice("living-room", &homie.Config{
+		Mqtt:      homie.MqttConfig{URL: broker.URL()},
+		BaseTopic: "homie/",
+		Version:   homie.HomieSpecVersion4,
+	})
+	assert.NoError(t, err)
+	n, err := d.NewNode("lamp", "Light")
+	assert.NoError(t, err)
+	p, err := n.NewProperty("brightness", homie.DataTypeInteger)
+	assert.NoError(t, err)
+	p.SetValue("40").SetHandler(func(p homie.Property, payload []byte, topic string) (bool, error) {
+		p.SetValue(string(payload)).Publish()
+		return true, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+	assert.True(t, broker.WaitRetained("homie/living-room/$state", homie.StateReady, time.Second))
+
+	c, err := start(ctx, "living-room", nil)
+	assert.NoError(t, err)
+	var out bytes.Buffer
+	assert.NoError(t, printDevices(&out, c, true))
+	var devices []deviceJSON
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &devices))
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "40", devices[0].Nodes[0].Properties[0].Value)
+
+	assert.NoError(t, run(ctx, "set", []string{"living-room/lamp/brightness", "70"}))
+	assert.True(t, errors.Is(run(ctx, "set", []string{"living-room/lamp/brightness", "on"}), homie.ErrInvalidValue))
+	assert.True(t, errors.Is(run(ctx, "get", []string{"living-room/lamp"}), errUsage))
+	assert.True(t, errors.Is(run(ctx, "get", []string{"kitchen/lamp/brightness"}), controller.ErrDeviceNotFound))
+	assert.NoError(t, run(ctx, "wipe", []string{"living-room"}))
+	assert.Empty(t, broker.RetainedTopics("homie/living-room/#"))
+
+	// stale topics of devices which are not announced
+	broker.Publish("homie/stale/lamp/brightness", []byte("10"), true)
+	broker.Publish("homie/5/stale/lamp/brightness", []byte("10"), true)
+	assert.NoError(t, run(ctx, "wipe", []string{"stale"}))
+	assert.Empty(t, broker.RetainedTopics("homie/stale/#"))
+	assert.Empty(t, broker.RetainedTopics("homie/5/stale/#"))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/masgari/homie-go/controller"
+)
+
+// timeFormat timestamp of watched changes
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+type deviceJSON struct {
+	ID    string     `json:"id"`
+	Name  string     `json:"name"`
+	Homie string     `json:"homie"`
+	State string     `json:"state"`
+	Nodes []nodeJSON `json:"nodes"`
+}
+
+type nodeJSON struct {
+	ID         string         `json:"id"`
+	Name       string         `json:"name"`
+	Type       string         `json:"type,omitempty"`
+	Properties []propertyJSON `json:"properties"`
+}
+
+type propertyJSON struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Datatype string `json:"datatype"`
+	Format   string `json:"format,omitempty"`
+	Unit     string `json:"unit,omitempty"`
+	Settable bool   `json:"settable"`
+	Retained bool   `json:"retained"`
+	Value    string `json:"value,omitempty"`
+	Target   string `json:"target,omitempty"`
+}
+
+func newDeviceJSON(d controller.Device) deviceJSON {
+	result := deviceJSON{ID: d.Name(), Name: d.FriendlyName(), Homie: d.Homie(), State: d.State(), Nodes: []nodeJSON{}}
+	for _, nodeName := range d.NodeNames() {
+		n := d.GetNode(nodeName)
+		node := nodeJSON{ID: n.Name(), Name: n.FriendlyName(), Type: n.Type(), Properties: []propertyJSON{}}
+		for _, propertyName := range n.PropertyNames() {
+			p := n.GetProperty(propertyName)
+			node.Properties = append(node.Properties, propertyJSON{
+				ID:       p.Name(),
+				Name:     p.FriendlyName(),
+				Datatype: p.Type(),
+				Format:   p.Format(),
+				Unit:     p.Unit(),
+				Settable: p.Settable(),
+				Retained: p.Retained(),
+				Value:    p.Value(),
+				Target:   p.Target(),
+			})
+		}
+		result.Nodes = append(result.Nodes, node)
+	}
+	return result
+}
+
+// printDevices print discovered devices as a tree or JSON
+func printDevices(w io.Writer, c controller.Controller, asJSON bool) error {
+	devices := []deviceJSON{}
+	for _, name := range c.DeviceNames() {
+		if d := c.GetDevice(name); d != nil {
+			devices = append(devices, newDeviceJSON(d))
+		}
+	}
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(devices)
+	}
+	for _, d := range devices {
+		fmt.Fprintf(w, "%s (%s) homie %s, %s\n", d.ID, d.Name, d.Homie, d.State)
+		for _, n := range d.Nodes {
+			fmt.Fprintf(w, "  %s (%s) %s\n", n.ID, n.Name, n.Type)
+			for _, p := range n.Properties {
+				details := []string{p.Datatype}
+				if p.Format != "" {
+					details = append(details, p.Format)
+				}
+				if p.Unit != "" {
+					details = append(details, p.Unit)
+				}
+				if p.Settable {
+					details = append(details, "settable")
+				}
+				if !p.Retained {
+					details = append(details, "not retained")
+				}
+				fmt.Fprintf(w, "    %s (%s) %s = %s\n", p.ID, p.Name, strings.Join(details, ", "), p.Value)
+			}
+		}
+	}
+	return nil
+}
+
+// printEvent returns an event handler to print value and state changes of a device or all devices if it is empty
+func printEvent(w io.Writer, device string) controller.EventHandler {
+	return func(e controller.Event) {
+		if device != "" && e.Device.Name() != device {
+			return
+		}
+		now := time.Now().Format(timeFormat)
+		switch e.Type {
+		case controller.EventPropertyValue:
+			fmt.Fprintf(w, "%s %s/%s/%s %s\n", now, e.Device.Name(), e.Node.Name(), e.Property.Name(), e.Value)
+		case controller.EventPropertyTarget:
+			fmt.Fprintf(w, "%s %s/%s/%s/$target %s\n", now, e.Device.Name(), e.Node.Name(), e.Property.Name(), e.Value)
+		case controller.EventStateChanged, controller.EventDeviceLost:
+			fmt.Fprintf(w, "%s %s/$state %s\n", now, e.Device.Name(), e.Value)
+		case controller.EventDeviceAdded:
+			fmt.Fprintf(w, "%s %s added\n", now, e.Device.Name())
+		case controller.EventDeviceRemoved:
+			fmt.Fprintf(w, "%s %s removed\n", now, e.Device.Name())
+		}
+	}
+}
@@ -0,0 +1,461 @@
+// Package controller discovers Homie devices on a broker and keeps a read-only model of their nodes and properties
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/masgari/homie-go/homie"
+	"github.com/masgari/homie-go/internal/mqttutil"
+)
+
+// settleTime time to wait for retained topics of a new device after subscribing them
+const settleTime = 300 * time.Millisecond
+
+// subscribeTimeout max wait for a subscription to be acknowledged
+const subscribeTimeout = 10 * time.Second
+
+// Config controller config
+type Config struct {
+	Mqtt      homie.MqttConfig
+	BaseTopic string // must end with '/', the same base topic as devices, for example homie/
+	ClientID  string // MQTT client ID, defaults to a random homie-controller-* ID
+	// AckTimeout if > 0 SetProperty waits until device publishes the new value (or $target in Homie 5)
+	AckTimeout time.Duration
+}
+
+// Controller discovers Homie 3, 4 and 5 devices and tracks their attributes, state and property values,
+// it is safe for concurrent use
+type Controller interface {
+	// Run connect to broker and block until ctx is done, returns homie.ErrConnectFailed if initial connect failed
+	// after all attempts of config.Mqtt.Retry, connection is restored automatically afterwards
+	Run(ctx context.Context) error
+	// DeviceNames returns sorted slice of discovered device IDs
+	DeviceNames() []string
+	GetDevice(name string) Device
+	// SetProperty validate value against remote $datatype and $format and publish it to /set topic of property,
+	// if config.AckTimeout is set it waits for device to publish the value and returns ErrRejected or ErrNoAck
+	SetProperty(ctx context.Context, device string, node string, property string, value string) error
+	// Client returns MQTT client of controller, nil before Run
+	Client() homie.MqttAdapter
+	// WipeDevice clear all retained topics of a discovered device, see homie.WipeDevice
+	WipeDevice(ctx context.Context, device string) error
+	// SetEventHandler set a handler to be notified about device changes
+	SetEventHandler(handler EventHandler) Controller
+}
+
+type controller struct {
+	config  *Config
+	client  mqtt.Client
+	devices map[string]*device
+	handler EventHandler
+
+	mutex sync.RWMutex
+}
+
+// New create a controller
+func New(cfg *Config) (Controller, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("%w: nil config", homie.ErrInvalidConfig)
+	}
+	if cfg.BaseTopic != "" && !strings.HasSuffix(cfg.BaseTopic, "/") {
+		return nil, fmt.Errorf("%w: base topic must end with '/': %s", homie.ErrInvalidConfig, cfg.BaseTopic)
+	}
+	if _, err := cfg.Mqtt.ClientOptions(); err != nil {
+		return nil, err
+	}
+	return &controller{
+		config:  cfg,
+		devices: make(map[string]*device),
+	}, nil
+}
+
+func (c *controller) Run(ctx context.Context) error {
+	opts, err := c.config.Mqtt.ClientOptions()
+	if err != nil {
+		return err
+	}
+	clientID := c.config.ClientID
+	if clientID == "" {
+		clientID = fmt.Sprintf("homie-controller-%x", rand.Int63())
+	}
+	opts.SetClientID(clientID)
+	opts.SetAutoReconnect(true)
+	if c.config.Mqtt.MaxReconnectInterval > 0 {
+		opts.SetMaxReconnectInterval(c.config.Mqtt.MaxReconnectInterval)
+	}
+	// subscriptions without callback are delivered to default handler
+	opts.SetDefaultPublishHandler(func(client mqtt.Client, message mqtt.Message) {
+		c.onMessage(message.Topic(), message.Payload())
+	})
+	opts.SetOnConnectHandler(c.subscribe)
+
+	client := mqtt.NewClient(opts)
+	c.mutex.Lock()
+	c.client = client
+	c.mutex.Unlock()
+	retry := c.config.Mqtt.Retry
+	err = mqttutil.Retry(ctx, "controller", retry.MaxAttempts, retry.Backoff, func() error {
+		return mqttutil.WaitToken(ctx, client.Connect())
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			err = fmt.Errorf("%w: %v", homie.ErrConnectFailed, err)
+		}
+		return err
+	}
+	<-ctx.Done()
+	client.Disconnect(250)
+	return nil
+}
+
+func (c *controller) DeviceNames() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	names := make([]string, 0, len(c.devices))
+	for name, d := range c.devices {
+		if d.announced {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *controller) GetDevice(name string) Device {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if d, ok := c.devices[name]; ok && d.announced {
+		return d
+	}
+	return nil
+}
+
+func (c *controller) SetEventHandler(handler EventHandler) Controller {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.handler = handler
+	return c
+}
+
+func (c *controller) SetProperty(ctx context.Context, deviceName string, nodeName string, propertyName string, value string) error {
+	p, client, err := c.settableProperty(deviceName, nodeName, propertyName)
+	if err != nil {
+		return err
+	}
+	if err := p.Validate(value); err != nil {
+		return err
+	}
+	if client == nil || !client.IsConnectionOpen() {
+		return fmt.Errorf("%w: controller", homie.ErrNotConnected)
+	}
+	var acks chan ack
+	if c.config.AckTimeout > 0 {
+		// watch before publish, device may answer before publish token is completed
+		acks = p.watch()
+		defer p.unwatch(acks)
+	}
+
+	topic := p.n.d.Topic(nodeName + "/" + propertyName + "/set")
+	publishCtx, cancel := context.WithTimeout(ctx, mqttutil.PublishTimeout(c.config.Mqtt.PublishTimeout))
+	defer cancel()
+	if err := mqttutil.WaitToken(publishCtx, client.Publish(topic, 1, false, value)); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			err = fmt.Errorf("%w: %s", homie.ErrPublishTimeout, topic)
+		}
+		return err
+	}
+	if acks == nil {
+		return nil
+	}
+
+	timeout := time.NewTimer(c.config.AckTimeout)
+	defer timeout.Stop()
+	// Homie 3/4 has no rejection signal, a different value may be published before the set is handled
+	var last *ack
+	for {
+		select {
+		case a := <-acks:
+			if sameValue(p.Type(), a.value, value) {
+				return nil
+			}
+			// Homie 5 value may change gradually towards $target, only a different $target is a rejection
+			if a.target {
+				return fmt.Errorf("%w: %s, expected %q, got %q", ErrRejected, topic, value, a.value)
+			}
+			if !p.n.d.version5 {
+				last = &a
+			}
+		case <-timeout.C:
+			if last != nil {
+				return fmt.Errorf("%w: %s, expected %q within %s, last value %q", ErrRejected, topic, value, c.config.AckTimeout, last.value)
+			}
+			return fmt.Errorf("%w: %s within %s", ErrNoAck, topic, c.config.AckTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *controller) Client() homie.MqttAdapter {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.client == nil {
+		return nil
+	}
+	return c.client
+}
+
+func (c *controller) WipeDevice(ctx context.Context, deviceName string) error {
+	c.mutex.RLock()
+	d, ok := c.devices[deviceName]
+	client := c.client
+	var desc *homie.Description
+	if ok {
+		// Homie version selects device topic, other topics are taken from retained messages
+		desc = &homie.Description{Homie: d.attributes["$homie"]}
+	}
+	c.mutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceName)
+	}
+	if client == nil {
+		return fmt.Errorf("%w: controller", homie.ErrNotConnected)
+	}
+	return homie.WipeDevice(ctx, client, c.config.BaseTopic, deviceName, desc)
+}
+
+// settableProperty find a settable property of a discovered device
+func (c *controller) settableProperty(deviceName string, nodeName string, propertyName string) (*property, mqtt.Client, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	d, ok := c.devices[deviceName]
+	if !ok || !d.announced {
+		return nil, nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceName)
+	}
+	if !contains(d.listed, nodeName) {
+		return nil, nil, fmt.Errorf("%w: %s/%s", homie.ErrNodeNotFound, deviceName, nodeName)
+	}
+	n := d.node(nodeName)
+	if !contains(n.listed, propertyName) {
+		return nil, nil, fmt.Errorf("%w: %s/%s/%s", homie.ErrPropertyNotFound, deviceName, nodeName, propertyName)
+	}
+	p := n.property(propertyName)
+	if p.attributes["$settable"] != "true" {
+		return nil, nil, fmt.Errorf("%w: %s/%s/%s", ErrNotSettable, deviceName, nodeName, propertyName)
+	}
+	return p, c.client, nil
+}
+
+// sameValue compare values, numbers are compared by value, for example 21 and 21.0
+func sameValue(dataType string, a string, b string) bool {
+	if a == b {
+		return true
+	}
+	if dataType != homie.DataTypeInteger && dataType != homie.DataTypeFloat {
+		return false
+	}
+	x, errA := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	y, errB := strconv.ParseFloat(strings.TrimSpace(b), 64)
+	return errA == nil && errB == nil && x == y
+}
+
+// subscribe subscribe device discovery topics and topics of known devices, called on each connect
+func (c *controller) subscribe(client mqtt.Client) {
+	client.Subscribe(c.config.BaseTopic+"+/$homie", 1, nil)
+	client.Subscribe(c.config.BaseTopic+"5/+/$state", 1, nil)
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, d := range c.devices {
+		client.Subscribe(d.prefix+"#", 1, nil)
+	}
+}
+
+func (c *controller) onMessage(topic string, payload []byte) {
+	c.mutex.Lock()
+	events := c.handleMessage(topic, string(payload))
+	handler := c.handler
+	c.mutex.Unlock()
+	emit(handler, events)
+}
+
+// settle wait for retained topics of a new device, brokers deliver them in no particular order,
+// device is added only after that so its model is complete
+func (c *controller) settle(d *device, token mqtt.Token) {
+	token.WaitTimeout(subscribeTimeout)
+	time.Sleep(settleTime)
+	c.mutex.Lock()
+	d.settled = true
+	var events []Event
+	if c.devices[d.id] == d && !d.announced && d.complete() {
+		d.announced = true
+		events = append(events, Event{Type: EventDeviceAdded, Device: d})
+	}
+	handler := c.handler
+	c.mutex.Unlock()
+	emit(handler, events)
+}
+
+func emit(handler EventHandler, events []Event) {
+	if handler == nil {
+		return
+	}
+	for _, e := range events {
+		handler(e)
+	}
+}
+
+// parseTopic returns device ID, device topic prefix, Homie 5 flag and topic parts relative to device topic
+func (c *controller) parseTopic(topic string) (string, string, bool, []string) {
+	if !strings.HasPrefix(topic, c.config.BaseTopic) {
+		return "", "", false, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(topic, c.config.BaseTopic), "/")
+	// Homie 5 devices are under base/5/, unless there is a Homie 3/4 device with ID 5
+	if parts[0] == "5" && len(parts) >= 3 {
+		if d, ok := c.devices["5"]; !ok || d.version5 {
+			return parts[1], c.config.BaseTopic + "5/" + parts[1] + "/", true, parts[2:]
+		}
+	}
+	if len(parts) < 2 {
+		return "", "", false, nil
+	}
+	return parts[0], c.config.BaseTopic + parts[0] + "/", false, parts[1:]
+}
+
+// handleMessage update device model and returns events, called with lock held
+func (c *controller) handleMessage(topic string, payload string) []Event {
+	id, prefix, version5, parts := c.parseTopic(topic)
+	if parts == nil {
+		return nil
+	}
+	d, ok := c.devices[id]
+	if !ok {
+		discovery := (!version5 && parts[0] == "$homie") || (version5 && parts[0] == "$state")
+		if !discovery || len(parts) != 1 || payload == "" {
+			return nil
+		}
+		d = newDevice(c, id, prefix, version5)
+		c.devices[id] = d
+		go c.settle(d, c.client.Subscribe(prefix+"#", 1, nil))
+	}
+	if d.version5 != version5 {
+		return nil
+	}
+
+	var events []Event
+	switch {
+	case strings.HasPrefix(parts[0], "$"):
+		name := strings.Join(parts, "/")
+		if payload == "" && (name == "$state" || (!version5 && name == "$homie")) {
+			return c.removeDevice(d)
+		}
+		if d.attributes[name] == payload {
+			return nil
+		}
+		d.attributes[name] = payload
+		switch name {
+		case "$nodes":
+			if !version5 {
+				d.listed = splitList(payload)
+			}
+		case "$description":
+			// description is cleared before $state when device is wiped
+			if version5 && payload != "" {
+				desc, err := homie.ParseDescription([]byte(payload))
+				if err != nil {
+					log.Printf("Invalid description of device %s: %v", id, err)
+					return nil
+				}
+				d.applyDescription(desc)
+			}
+		}
+		if !d.announced {
+			break
+		}
+		switch {
+		case name == "$state" && payload == homie.StateLost:
+			events = append(events, Event{Type: EventDeviceLost, Device: d, Attribute: name, Value: payload})
+		case name == "$state":
+			events = append(events, Event{Type: EventStateChanged, Device: d, Attribute: name, Value: payload})
+		default:
+			events = append(events, Event{Type: EventDeviceChanged, Device: d, Attribute: name, Value: payload})
+		}
+	case len(parts) == 2:
+		n := d.node(parts[0])
+		if strings.HasPrefix(parts[1], "$") {
+			if version5 || n.attributes[parts[1]] == payload {
+				return nil
+			}
+			n.attributes[parts[1]] = payload
+			if parts[1] == "$properties" {
+				n.listed = splitList(payload)
+			}
+			if d.announced {
+				events = append(events, Event{Type: EventDeviceChanged, Device: d, Node: n, Attribute: strings.Join(parts, "/"), Value: payload})
+			}
+			break
+		}
+		p := n.property(parts[1])
+		p.value = payload
+		p.notify(ack{value: payload})
+		if d.announced {
+			events = append(events, Event{Type: EventPropertyValue, Device: d, Node: n, Property: p, Value: payload})
+		}
+	case len(parts) == 3:
+		n := d.node(parts[0])
+		p := n.property(parts[1])
+		switch {
+		case parts[2] == "$target":
+			p.target = payload
+			p.notify(ack{value: payload, target: true})
+			if d.announced {
+				events = append(events, Event{Type: EventPropertyTarget, Device: d, Node: n, Property: p, Value: payload})
+			}
+		case strings.HasPrefix(parts[2], "$") && !version5:
+			if p.attributes[parts[2]] == payload {
+				return nil
+			}
+			p.attributes[parts[2]] = payload
+			if d.announced {
+				events = append(events, Event{Type: EventDeviceChanged, Device: d, Node: n, Property: p, Attribute: strings.Join(parts, "/"), Value: payload})
+			}
+		}
+	}
+
+	if !d.announced && d.complete() {
+		d.announced = true
+		events = append(events, Event{Type: EventDeviceAdded, Device: d})
+	}
+	return events
+}
+
+// removeDevice forget a device and unsubscribe its topics, called with lock held
+func (c *controller) removeDevice(d *device) []Event {
+	delete(c.devices, d.id)
+	c.client.Unsubscribe(d.prefix + "#")
+	if !d.announced {
+		return nil
+	}
+	return []Event{{Type: EventDeviceRemoved, Device: d}}
+}
+
+// splitList split a comma separated list of IDs, Homie 3 array suffix [] is removed
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSuffix(strings.TrimSpace(item), "[]"); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,230 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/masgari/homie-go/homie"
+	"github.com/masgari/homie-go/internal/mqtttest"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitEvent wait for an event of a type and device, other events are skipped
+func waitEvent(t *testing.T, events chan Event, eventType EventType, device string) Event {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == eventType && e.Device.Name() == device {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no %s event of device %s", eventType, device)
+			return Event{}
+		}
+	}
+}
+
+func runDevice(t *testing.T, broker *mqtttest.Broker, name string, version string) (homie.Device, homie.Property, context.CancelFunc) {
+	d, err := homie.NewDevice(name, &homie.Config{
+		Mqtt:      homie.MqttConfig{URL: broker.URL()},
+		BaseTopic: "homie/",
+		Version:   version,
+	})
+	assert.NoError(t, err)
+	d.SetFriendlyName("Living room")
+	n, err := d.NewNode("lamp", "Light")
+	assert.NoError(t, err)
+	p, err := n.NewProperty("brightness", homie.DataTypeInteger)
+	assert.NoError(t, err)
+	p.SetFormat(homie.RangeFormat(0, 100)).
+		SetUnit("%").
+		SetValue("40").
+		SetHandler(func(p homie.Property, payload []byte, topic string) (bool, error) {
+			// values above 80 are rejected, current value is published again
+			if v, _ := strconv.Atoi(string(payload)); v <= 80 {
+				p.SetValue(string(payload))
+			}
+			p.Publish()
+			return true, nil
+		})
+	_, err = n.NewProperty("power", homie.DataTypeFloat)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go d.Run(ctx)
+	return d, p, cancel
+}
+
+func TestController(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	for _, version := range []string{homie.HomieSpecVersion4, homie.HomieSpecVersion5} {
+		c, err := New(&Config{Mqtt: homie.MqttConfig{URL: broker.URL()}, BaseTopic: "homie/"})
+		assert.NoError(t, err)
+		events := make(chan Event, 100)
+		c.SetEventHandler(func(e Event) {
+			events <- e
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		go c.Run(ctx)
+
+		d, p, stop := runDevice(t, broker, "living-room", version)
+		waitEvent(t, events, EventDeviceAdded, "living-room")
+
+		remote := c.GetDevice("living-room")
+		assert.NotNil(t, remote, version)
+		assert.Equal(t, []string{"living-room"}, c.DeviceNames())
+		assert.Equal(t, version, remote.Homie())
+		assert.Equal(t, "Living room", remote.FriendlyName())
+		assert.Equal(t, homie.StateReady, remote.State())
+		assert.Equal(t, []string{"lamp"}, remote.NodeNames())
+		lamp := remote.GetNode("lamp")
+		assert.Equal(t, "Light", lamp.Type())
+		assert.Equal(t, []string{"brightness", "power"}, lamp.PropertyNames())
+		brightness := lamp.GetProperty("brightness")
+		assert.Equal(t, homie.DataTypeInteger, brightness.Type())
+		assert.Equal(t, "0:100", brightness.Format())
+		assert.Equal(t, "%", brightness.Unit())
+		assert.True(t, brightness.Settable())
+		assert.True(t, brightness.Retained())
+		assert.Equal(t, "40", brightness.Value())
+		assert.True(t, errors.Is(brightness.Validate("101"), homie.ErrInvalidValue))
+		assert.Equal(t, d.Topic("lamp/brightness/set"), remote.Topic("lamp/brightness/set"))
+
+		p.SetValue("70").Publish()
+		e := waitEvent(t, events, EventPropertyValue, "living-room")
+		if e.Value == "40" {
+			// retained value may be received after device is added
+			e = waitEvent(t, events, EventPropertyValue, "living-room")
+		}
+		assert.Equal(t, "70", e.Value)
+		assert.Equal(t, "brightness", e.Property.Name())
+		assert.Equal(t, "70", brightness.Value())
+
+		assert.NoError(t, d.Sleep())
+		e = waitEvent(t, events, EventStateChanged, "living-room")
+		assert.Equal(t, homie.StateSleeping, e.Value)
+
+		// device is removed when its topics are wiped
+		assert.NoError(t, d.Wipe(context.Background()))
+		waitEvent(t, events, EventDeviceRemoved, "living-room")
+		assert.Nil(t, c.GetDevice("living-room"))
+		stop()
+		cancel()
+	}
+}
+
+func TestDeviceLost(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	c, err := New(&Config{Mqtt: homie.MqttConfig{URL: broker.URL()}, BaseTopic: "homie/"})
+	assert.NoError(t, err)
+	events := make(chan Event, 100)
+	c.SetEventHandler(func(e Event) {
+		events <- e
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	// a device is lost when broker publishes its will
+	broker.Publish("homie/sensor/$homie", []byte(homie.HomieSpecVersion), true)
+	broker.Publish("homie/sensor/$state", []byte(homie.StateReady), true)
+	waitEvent(t, events, EventDeviceAdded, "sensor")
+	broker.Publish("homie/sensor/$state", []byte(homie.StateLost), true)
+	waitEvent(t, events, EventDeviceLost, "sensor")
+	assert.Equal(t, homie.StateLost, c.GetDevice("sensor").State())
+
+	_, err = New(&Config{BaseTopic: "homie"})
+	assert.True(t, errors.Is(err, homie.ErrInvalidConfig))
+}
+
+func TestSetProperty(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	for _, version := range []string{homie.HomieSpecVersion4, homie.HomieSpecVersion5} {
+		c, err := New(&Config{Mqtt: homie.MqttConfig{URL: broker.URL()}, BaseTopic: "homie/", AckTimeout: 500 * time.Millisecond})
+		assert.NoError(t, err)
+		events := make(chan Event, 100)
+		c.SetEventHandler(func(e Event) {
+			events <- e
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		go c.Run(ctx)
+
+		d, _, stop := runDevice(t, broker, "living-room", version)
+		waitEvent(t, events, EventDeviceAdded, "living-room")
+
+		assert.NoError(t, c.SetProperty(ctx, "living-room", "lamp", "brightness", "70"), version)
+		brightness := c.GetDevice("living-room").GetNode("lamp").GetProperty("brightness")
+		err = c.SetProperty(ctx, "living-room", "lamp", "brightness", "90")
+		if version == homie.HomieSpecVersion5 {
+			assert.Equal(t, "90", brightness.Target())
+			// $target is published for valid values, handler decides later
+			assert.NoError(t, err)
+		} else {
+			assert.True(t, errors.Is(err, ErrRejected), err)
+			assert.Equal(t, "70", brightness.Value())
+		}
+		err = c.SetProperty(ctx, "living-room", "lamp", "brightness", "101")
+		assert.True(t, errors.Is(err, homie.ErrInvalidValue), err)
+		err = c.SetProperty(ctx, "living-room", "lamp", "power", "1")
+		assert.True(t, errors.Is(err, ErrNotSettable), err)
+		err = c.SetProperty(ctx, "living-room", "lamp", "color", "1")
+		assert.True(t, errors.Is(err, homie.ErrPropertyNotFound), err)
+		err = c.SetProperty(ctx, "kitchen", "lamp", "brightness", "1")
+		assert.True(t, errors.Is(err, ErrDeviceNotFound), err)
+
+		assert.NoError(t, d.Wipe(context.Background()))
+		stop()
+		cancel()
+	}
+}
+
+func TestSetPropertyIgnored(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	c, err := New(&Config{Mqtt: homie.MqttConfig{URL: broker.URL()}, BaseTopic: "homie/", AckTimeout: 200 * time.Millisecond})
+	assert.NoError(t, err)
+	events := make(chan Event, 100)
+	c.SetEventHandler(func(e Event) {
+		events <- e
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	// nobody handles set commands of this device
+	for topic, payload := range map[string]string{
+		"$homie": homie.HomieSpecVersion4, "$name": "Relay", "$state": homie.StateReady, "$nodes": "relay",
+		"relay/$name": "Relay", "relay/$properties": "on", "relay/on/$datatype": homie.DataTypeBoolean, "relay/on/$settable": "true",
+	} {
+		broker.Publish("homie/relay/"+topic, []byte(payload), true)
+	}
+	waitEvent(t, events, EventDeviceAdded, "relay")
+	err = c.SetProperty(ctx, "relay", "relay", "on", "true")
+	assert.True(t, errors.Is(err, ErrNoAck), err)
+
+	// a previous value published before the set is handled is not a rejection
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		broker.Publish("homie/relay/relay/on", []byte("false"), true)
+		time.Sleep(50 * time.Millisecond)
+		broker.Publish("homie/relay/relay/on", []byte("true"), true)
+	}()
+	assert.NoError(t, c.SetProperty(ctx, "relay", "relay", "on", "true"))
+	err = c.SetProperty(ctx, "relay", "relay", "on", "yes")
+	assert.True(t, errors.Is(err, homie.ErrInvalidValue), err)
+}
@@ -0,0 +1,17 @@
+package controller
+
+import "errors"
+
+// Errors returned by controller, use errors.Is to check them, homie errors like homie.ErrInvalidValue,
+// homie.ErrNodeNotFound or homie.ErrNotConnected are returned as well
+var (
+	// ErrDeviceNotFound device is not discovered
+	ErrDeviceNotFound = errors.New("device not found")
+	// ErrNotSettable property is not settable
+	ErrNotSettable = errors.New("property not settable")
+	// ErrRejected device published a different $target (Homie 5) after a set command, or only different values
+	// within config.AckTimeout (Homie 3/4)
+	ErrRejected = errors.New("set rejected by device")
+	// ErrNoAck device did not publish the new value within config.AckTimeout
+	ErrNoAck = errors.New("set not acknowledged by device")
+)
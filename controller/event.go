@@ -0,0 +1,37 @@
+package controller
+
+// EventType type of controller events
+type EventType string
+
+// Controller event types
+const (
+	// EventDeviceAdded a device is discovered, it is not in init state and its Homie version (or Homie 5 description) is known
+	EventDeviceAdded EventType = "device-added"
+	// EventDeviceChanged an attribute of device, node or property is changed, for example $nodes or $name
+	EventDeviceChanged EventType = "device-changed"
+	// EventStateChanged device $state is changed, except lost state
+	EventStateChanged EventType = "state-changed"
+	// EventDeviceLost device $state is lost, device is disconnected unexpectedly
+	EventDeviceLost EventType = "device-lost"
+	// EventDeviceRemoved device topics are cleared, for example device is wiped
+	EventDeviceRemoved EventType = "device-removed"
+	// EventPropertyValue a property value is received
+	EventPropertyValue EventType = "property-value"
+	// EventPropertyTarget a Homie 5 property $target is received
+	EventPropertyTarget EventType = "property-target"
+)
+
+// Event a change of a remote device, Node and Property are set for node and property changes
+type Event struct {
+	Type     EventType
+	Device   Device
+	Node     Node
+	Property Property
+	// Attribute changed attribute relative to device topic, for example $nodes or node/$name
+	Attribute string
+	// Value new value of property, state or attribute
+	Value string
+}
+
+// EventHandler called for controller events, it is called from MQTT client goroutine, keep it short
+type EventHandler func(e Event)
@@ -0,0 +1,392 @@
+package controller
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/masgari/homie-go/homie"
+	"github.com/masgari/homie-go/internal/defaults"
+)
+
+// Device remote Homie device, read-only view of discovered attributes, nodes and properties
+type Device interface {
+	// Name device ID, used in topics
+	Name() string
+	// FriendlyName $name of device, defaults to Name()
+	FriendlyName() string
+	// Homie Homie convention version of device, for example 4.0.0
+	Homie() string
+	// State last published $state, for example ready or lost
+	State() string
+	Extensions() []string
+	// Attribute returns a device attribute, for example $localip or $stats/uptime, empty if not published
+	Attribute(name string) string
+	// NodeNames returns sorted slice of device nodes
+	NodeNames() []string
+	GetNode(name string) Node
+	// Topic returns full topic for a part, for example node/property/set
+	Topic(part string) string
+	// Description returns discovered nodes and properties in Homie 5 description format, for all Homie versions
+	Description() *homie.Description
+}
+
+// Node remote Homie node
+type Node interface {
+	// Name node ID, used in topics
+	Name() string
+	// FriendlyName $name of node, defaults to Name()
+	FriendlyName() string
+	Type() string
+	Device() Device
+	// PropertyNames returns sorted slice of node properties
+	PropertyNames() []string
+	GetProperty(name string) Property
+}
+
+// Property remote Homie property
+type Property interface {
+	// Name property ID, used in topics
+	Name() string
+	// FriendlyName $name of property, defaults to Name()
+	FriendlyName() string
+	// Type property datatype, defaults to "string"
+	Type() string
+	Unit() string
+	Format() string
+	Settable() bool
+	// Retained whether property value is retained, defaults to true
+	Retained() bool
+	// Value last received value
+	Value() string
+	// Target Homie 5 target value
+	Target() string
+	// Validate check a value against property datatype and format
+	Validate(value string) error
+	Node() Node
+}
+
+type device struct {
+	c          *controller
+	id         string
+	prefix     string // full topic prefix of device, ends with '/'
+	version5   bool
+	attributes map[string]string
+	listed     []string // nodes listed in $nodes or $description
+	nodes      map[string]*node
+	settled    bool // retained topics are received
+	announced  bool // added event is emitted
+}
+
+type node struct {
+	d          *device
+	id         string
+	attributes map[string]string
+	listed     []string // properties listed in $properties or $description
+	properties map[string]*property
+}
+
+type property struct {
+	n          *node
+	id         string
+	attributes map[string]string
+	value      string
+	target     string
+	watchers   map[chan ack]struct{}
+}
+
+// ack a value or $target published by device
+type ack struct {
+	value  string
+	target bool
+}
+
+func newDevice(c *controller, id string, prefix string, version5 bool) *device {
+	return &device{
+		c:          c,
+		id:         id,
+		prefix:     prefix,
+		version5:   version5,
+		attributes: make(map[string]string),
+		nodes:      make(map[string]*node),
+	}
+}
+
+func (d *device) Name() string {
+	return d.id
+}
+
+func (d *device) FriendlyName() string {
+	return defaults.String(d.Attribute("$name"), d.id)
+}
+
+func (d *device) Homie() string {
+	return d.Attribute("$homie")
+}
+
+func (d *device) State() string {
+	return d.Attribute("$state")
+}
+
+func (d *device) Extensions() []string {
+	extensions := d.Attribute("$extensions")
+	if extensions == "" {
+		return nil
+	}
+	return strings.Split(extensions, ",")
+}
+
+func (d *device) Attribute(name string) string {
+	d.c.mutex.RLock()
+	defer d.c.mutex.RUnlock()
+	return d.attributes[name]
+}
+
+func (d *device) NodeNames() []string {
+	d.c.mutex.RLock()
+	defer d.c.mutex.RUnlock()
+	return sortedCopy(d.listed)
+}
+
+func (d *device) GetNode(name string) Node {
+	// listed node may not be created yet
+	d.c.mutex.Lock()
+	defer d.c.mutex.Unlock()
+	if !contains(d.listed, name) {
+		return nil
+	}
+	return d.node(name)
+}
+
+func (d *device) Topic(part string) string {
+	return d.prefix + part
+}
+
+func (d *device) Description() *homie.Description {
+	d.c.mutex.Lock()
+	defer d.c.mutex.Unlock()
+	desc := &homie.Description{
+		Homie: d.attributes["$homie"],
+		Name:  defaults.String(d.attributes["$name"], d.id),
+		Nodes: make(map[string]homie.NodeDescription),
+	}
+	if extensions := d.attributes["$extensions"]; extensions != "" {
+		desc.Extensions = strings.Split(extensions, ",")
+	}
+	for _, nodeID := range d.listed {
+		n := d.node(nodeID)
+		nodeDesc := homie.NodeDescription{
+			Name:       defaults.String(n.attributes["$name"], nodeID),
+			Type:       n.attributes["$type"],
+			Properties: make(map[string]homie.PropertyDescription),
+		}
+		for _, propID := range n.listed {
+			p := n.property(propID)
+			nodeDesc.Properties[propID] = homie.PropertyDescription{
+				Name:     defaults.String(p.attributes["$name"], propID),
+				Datatype: defaults.String(p.attributes["$datatype"], homie.DataTypeString),
+				Format:   p.attributes["$format"],
+				Settable: p.attributes["$settable"] == "true",
+				Retained: p.attributes["$retained"] != "false",
+				Unit:     p.attributes["$unit"],
+			}
+		}
+		desc.Nodes[nodeID] = nodeDesc
+	}
+	return desc
+}
+
+// node returns a node, it is created if it is not known yet, called with lock held
+func (d *device) node(id string) *node {
+	n, ok := d.nodes[id]
+	if !ok {
+		n = &node{d: d, id: id, attributes: make(map[string]string), properties: make(map[string]*property)}
+		d.nodes[id] = n
+	}
+	return n
+}
+
+// complete a device is complete when its retained topics are received, it is initialized and
+// its Homie version (or description in Homie 5) is known
+func (d *device) complete() bool {
+	if !d.settled {
+		return false
+	}
+	if state := d.attributes["$state"]; state == "" || state == homie.StateInit {
+		return false
+	}
+	if d.version5 {
+		return d.attributes["$description"] != ""
+	}
+	return d.attributes["$homie"] != ""
+}
+
+// applyDescription update device, nodes and properties from Homie 5 $description, called with lock held
+func (d *device) applyDescription(desc *homie.Description) {
+	d.attributes["$homie"] = desc.Homie
+	d.attributes["$name"] = desc.Name
+	d.attributes["$extensions"] = strings.Join(desc.Extensions, ",")
+	d.listed = d.listed[:0]
+	for nodeID, nodeDesc := range desc.Nodes {
+		d.listed = append(d.listed, nodeID)
+		n := d.node(nodeID)
+		n.attributes["$name"] = nodeDesc.Name
+		n.attributes["$type"] = nodeDesc.Type
+		n.listed = n.listed[:0]
+		for propID, propDesc := range nodeDesc.Properties {
+			n.listed = append(n.listed, propID)
+			p := n.property(propID)
+			p.attributes["$name"] = propDesc.Name
+			p.attributes["$datatype"] = propDesc.Datatype
+			p.attributes["$format"] = propDesc.Format
+			p.attributes["$unit"] = propDesc.Unit
+			p.attributes["$settable"] = strconv.FormatBool(propDesc.Settable)
+			p.attributes["$retained"] = strconv.FormatBool(propDesc.Retained)
+		}
+	}
+}
+
+func (n *node) Name() string {
+	return n.id
+}
+
+func (n *node) FriendlyName() string {
+	return defaults.String(n.attribute("$name"), n.id)
+}
+
+func (n *node) Type() string {
+	return n.attribute("$type")
+}
+
+func (n *node) Device() Device {
+	return n.d
+}
+
+func (n *node) PropertyNames() []string {
+	n.d.c.mutex.RLock()
+	defer n.d.c.mutex.RUnlock()
+	return sortedCopy(n.listed)
+}
+
+func (n *node) GetProperty(name string) Property {
+	// listed property may not be created yet
+	n.d.c.mutex.Lock()
+	defer n.d.c.mutex.Unlock()
+	if !contains(n.listed, name) {
+		return nil
+	}
+	return n.property(name)
+}
+
+func (n *node) attribute(name string) string {
+	n.d.c.mutex.RLock()
+	defer n.d.c.mutex.RUnlock()
+	return n.attributes[name]
+}
+
+// property returns a property, it is created if it is not known yet, called with lock held
+func (n *node) property(id string) *property {
+	p, ok := n.properties[id]
+	if !ok {
+		p = &property{n: n, id: id, attributes: make(map[string]string)}
+		n.properties[id] = p
+	}
+	return p
+}
+
+func (p *property) Name() string {
+	return p.id
+}
+
+func (p *property) FriendlyName() string {
+	return defaults.String(p.attribute("$name"), p.id)
+}
+
+func (p *property) Type() string {
+	return defaults.String(p.attribute("$datatype"), homie.DataTypeString)
+}
+
+func (p *property) Unit() string {
+	return p.attribute("$unit")
+}
+
+func (p *property) Format() string {
+	return p.attribute("$format")
+}
+
+func (p *property) Settable() bool {
+	return p.attribute("$settable") == "true"
+}
+
+func (p *property) Retained() bool {
+	return p.attribute("$retained") != "false"
+}
+
+func (p *property) Value() string {
+	p.n.d.c.mutex.RLock()
+	defer p.n.d.c.mutex.RUnlock()
+	return p.value
+}
+
+func (p *property) Target() string {
+	p.n.d.c.mutex.RLock()
+	defer p.n.d.c.mutex.RUnlock()
+	return p.target
+}
+
+func (p *property) Validate(value string) error {
+	return homie.ValidateValue(p.Type(), p.Format(), value)
+}
+
+func (p *property) Node() Node {
+	return p.n
+}
+
+// watch returns a channel to receive published values and targets of property
+func (p *property) watch() chan ack {
+	p.n.d.c.mutex.Lock()
+	defer p.n.d.c.mutex.Unlock()
+	if p.watchers == nil {
+		p.watchers = make(map[chan ack]struct{})
+	}
+	acks := make(chan ack, 8)
+	p.watchers[acks] = struct{}{}
+	return acks
+}
+
+func (p *property) unwatch(acks chan ack) {
+	p.n.d.c.mutex.Lock()
+	defer p.n.d.c.mutex.Unlock()
+	delete(p.watchers, acks)
+}
+
+// notify send a published value to watchers, slow watchers miss values, called with lock held
+func (p *property) notify(a ack) {
+	for acks := range p.watchers {
+		select {
+		case acks <- a:
+		default:
+		}
+	}
+}
+
+func (p *property) attribute(name string) string {
+	p.n.d.c.mutex.RLock()
+	defer p.n.d.c.mutex.RUnlock()
+	return p.attributes[name]
+}
+
+func sortedCopy(values []string) []string {
+	result := append([]string{}, values...)
+	sort.Strings(result)
+	return result
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
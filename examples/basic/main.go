@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	homie "github.com/masgari/homie-go/homie"
@@ -28,7 +32,7 @@ func periodicRandomIntPublisher(tickerPriod string) (homie.PeriodicPublisher, er
 }
 
 func main() {
-	device := homie.NewDevice("test1", &homie.Config{
+	device, err := homie.NewDevice("test1", &homie.Config{
 		Mqtt: homie.MqttConfig{
 			Host:     "localhost",
 			Port:     1883,
@@ -38,33 +42,58 @@ func main() {
 		BaseTopic:           "devices/",
 		StatsReportInterval: 60,
 	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	homie.NewDevicePublisher(device)
+	if _, err := homie.NewDevicePublisher(device); err != nil {
+		log.Fatal(err)
+	}
 
 	publisher, _ = periodicRandomIntPublisher("1s")
 
-	node := device.NewNode("RandomGenerator", "RandomValueGeneratorNode")
+	node, err := device.NewNode("random-generator", "RandomValueGeneratorNode")
+	if err != nil {
+		log.Fatal(err)
+	}
+	node.SetFriendlyName("Random generator")
 
 	publisher.AddNodePublisher(node, randomPropertySetter)
 
-	node.NewProperty("value", "integer")
+	if _, err := node.NewProperty("value", homie.DataTypeInteger); err != nil {
+		log.Fatal(err)
+	}
 
-	// to change interval, send a message to: devices/test1/RandomGenerator/interval/set
+	// to change interval, send a message to: devices/test1/random-generator/interval/set
 	// sample intervals: 200ms, 3s
-	node.NewProperty("interval", "integer").
-		SetHandler(func(p homie.Property, payload []byte, topic string) (bool, error) {
-			interval := string(payload)
-			publisher.Close() // close current publisher
-			newPublisher, err := periodicRandomIntPublisher(interval)
-			if err != nil {
-				log.Fatalf("Invalid ticker duration: %s, %v", interval, err)
-				return false, err
-			}
-			publisher = newPublisher
-			publisher.AddNodePublisher(node, randomPropertySetter)
-			// invoke publisher again
-			publisher.Start()
-			return true, nil
-		})
-	device.Run(true)
+	intervalProp, err := node.NewProperty("interval", homie.DataTypeString)
+	if err != nil {
+		log.Fatal(err)
+	}
+	intervalProp.SetHandler(func(p homie.Property, payload []byte, topic string) (bool, error) {
+		interval := string(payload)
+		newPublisher, err := periodicRandomIntPublisher(interval)
+		if err != nil {
+			return false, fmt.Errorf("invalid ticker duration: %s, %v", interval, err)
+		}
+		publisher.Close() // close current publisher
+		publisher = newPublisher
+		publisher.AddNodePublisher(node, randomPropertySetter)
+		// invoke publisher again
+		publisher.Start()
+		return true, nil
+	})
+
+	// publish $state=disconnected instead of lost on Ctrl+C or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		cancel()
+	}()
+
+	if err := device.Run(ctx); err != nil { // block until ctx is cancelled
+		log.Fatal(err)
+	}
 }
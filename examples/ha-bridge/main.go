@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	homeassistant "github.com/masgari/homie-go/homeassistant"
+	homie "github.com/masgari/homie-go/homie"
+)
+
+// expose zigbee2mqtt, ESPHome and other Home Assistant discovered entities as Homie 4.0 devices
+func main() {
+	bridge, err := homeassistant.NewReverseBridge(&homeassistant.ReverseConfig{
+		DiscoveryPrefix: "homeassistant/",
+		Device: homie.Config{
+			Mqtt: homie.MqttConfig{
+				Host:     "localhost",
+				Port:     1883,
+				Username: "user",
+				Password: "password",
+			},
+			BaseTopic: "homie/",
+			Version:   homie.HomieSpecVersion4,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// devices publish $state=disconnected on Ctrl+C or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		cancel()
+	}()
+
+	if err := bridge.Run(ctx); err != nil { // block until ctx is cancelled
+		log.Fatal(err)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"time"
 
 	homie "github.com/masgari/homie-go/homie"
@@ -23,10 +25,18 @@ func formatByteCount(b uint64) string {
 	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "kMGTPE"[exp])
 }
 
-func configureMemoryNode(device homie.Device, publisher homie.PeriodicPublisher) {
-	memNode := device.NewNode("Memory", "MemoryNode")
-	memNode.NewProperty("total", "integer")
-	memNode.NewProperty("free", "integer")
+func configureMemoryNode(device homie.Device, publisher homie.PeriodicPublisher) error {
+	memNode, err := device.NewNode("memory", "MemoryNode")
+	if err != nil {
+		return err
+	}
+	memNode.SetFriendlyName("Memory")
+	if _, err := memNode.NewProperty("total", homie.DataTypeString); err != nil {
+		return err
+	}
+	if _, err := memNode.NewProperty("free", homie.DataTypeString); err != nil {
+		return err
+	}
 	publisher.AddNodePublisher(memNode, func(n homie.Node) {
 		totalProp := n.GetProperty("total")
 		freeProp := n.GetProperty("free")
@@ -36,29 +46,40 @@ func configureMemoryNode(device homie.Device, publisher homie.PeriodicPublisher)
 		totalProp.Publish()
 		freeProp.Publish()
 	})
+	return nil
 }
 
-func configureCPUNode(device homie.Device, publisher homie.PeriodicPublisher) {
-	cpuNode := device.NewNode("CPU", "CPUNode")
-	cpuNode.NewProperty("usage", "float")
-	cpuNode.NewProperty("load", "float")
+func configureCPUNode(device homie.Device, publisher homie.PeriodicPublisher) error {
+	cpuNode, err := device.NewNode("cpu", "CPUNode")
+	if err != nil {
+		return err
+	}
+	cpuNode.SetFriendlyName("CPU")
+	if _, err := cpuNode.NewProperty("usage", homie.DataTypeFloat); err != nil {
+		return err
+	}
+	if _, err := cpuNode.NewProperty("load", homie.DataTypeFloat); err != nil {
+		return err
+	}
 	publisher.AddNodePublisher(cpuNode, func(n homie.Node) {
 		usageProp := n.GetProperty("usage")
 		loadProp := n.GetProperty("load")
-		cpuUsage, _ := cpu.Percent(0, false)
-		usageProp.SetValue(fmt.Sprintf("%.2f", cpuUsage))
+		if cpuUsage, _ := cpu.Percent(0, false); len(cpuUsage) > 0 {
+			usageProp.SetValue(fmt.Sprintf("%.2f", cpuUsage[0]))
+		}
 		loadStats, _ := load.Avg()
 		loadProp.SetValue(fmt.Sprintf("%.2f", loadStats.Load1))
 		usageProp.Publish()
 		loadProp.Publish()
 	})
+	return nil
 }
 
 func main() {
 	// publish system stats every 5 seconds
 	statsPublisher := homie.NewPeriodicPublisher(time.Duration(5 * time.Second))
 
-	device := homie.NewDevice("sys-info", &homie.Config{
+	device, err := homie.NewDevice("sys-info", &homie.Config{
 		Mqtt: homie.MqttConfig{
 			Host:     "localhost",
 			Port:     1883,
@@ -68,9 +89,20 @@ func main() {
 		BaseTopic:           "devices/",
 		StatsReportInterval: 60,
 	})
-	configureMemoryNode(device, statsPublisher)
-	configureCPUNode(device, statsPublisher)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := configureMemoryNode(device, statsPublisher); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureCPUNode(device, statsPublisher); err != nil {
+		log.Fatal(err)
+	}
 
-	homie.NewDevicePublisher(device) // report uptime every 60s
-	device.Run(true)
+	if _, err := homie.NewDevicePublisher(device); err != nil { // report uptime every 60s
+		log.Fatal(err)
+	}
+	if err := device.Run(context.Background()); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -1,14 +1,14 @@
 module github.com/masgari/homie-go
 
-go 1.12
+go 1.13
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/shirou/gopsutil v2.18.12+incompatible
+	go.etcd.io/bbolt v1.3.6
 
 	// test
 	github.com/stretchr/objx v0.2.0 // indirect
 	github.com/stretchr/testify v1.3.0
 	golang.org/x/net v0.0.0-20190424112056-4829fb13d2c6 // indirect
-
 )
@@ -0,0 +1,133 @@
+// Package homeassistant publishes Home Assistant MQTT discovery configs for Homie devices
+package homeassistant
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/masgari/homie-go/controller"
+	"github.com/masgari/homie-go/homie"
+	"github.com/masgari/homie-go/internal/mqttutil"
+)
+
+// DefaultDiscoveryPrefix default Home Assistant discovery prefix
+const DefaultDiscoveryPrefix = "homeassistant/"
+
+// Config bridge config
+type Config struct {
+	DiscoveryPrefix string // must end with '/', default homeassistant/
+}
+
+// Bridge publishes a Home Assistant discovery config for each property of Homie devices, configs are updated when
+// a device is ready again after its nodes are changed and removed when nodes or properties disappear.
+// Entities are available only when device $state is ready.
+type Bridge interface {
+	// AddDevice publish configs of a local device each time it is ready, it should be called before device.Run,
+	// it sets wipe handler of device to remove configs when device is wiped
+	AddDevice(d homie.Device) Bridge
+	// AddController publish configs of devices discovered by a controller, it sets event handler of controller,
+	// handler (can be nil) is called for all events after the bridge
+	AddController(c controller.Controller, handler controller.EventHandler) Bridge
+}
+
+type bridge struct {
+	config    *Config
+	published map[string]map[string]string // device topic -> config topic -> payload
+	mutex     sync.Mutex
+}
+
+// NewBridge create a Home Assistant discovery bridge
+func NewBridge(cfg *Config) (Bridge, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	if cfg.DiscoveryPrefix == "" {
+		cfg.DiscoveryPrefix = DefaultDiscoveryPrefix
+	}
+	if !strings.HasSuffix(cfg.DiscoveryPrefix, "/") {
+		return nil, fmt.Errorf("%w: discovery prefix must end with '/': %s", homie.ErrInvalidConfig, cfg.DiscoveryPrefix)
+	}
+	return &bridge{
+		config:    cfg,
+		published: make(map[string]map[string]string),
+	}, nil
+}
+
+func (b *bridge) AddDevice(d homie.Device) Bridge {
+	d.Subscribe("$state", 1, func(client mqtt.Client, message mqtt.Message) {
+		if string(message.Payload()) == homie.StateReady {
+			b.sync(client, d.Name(), d.Topic(""), d.Description())
+		}
+	})
+	// $state is unsubscribed before wipe, configs are removed by the wipe handler
+	d.SetOnWipe(func(ctx context.Context, d homie.Device) error {
+		for _, token := range b.remove(d.Client(), d.Topic("")) {
+			if err := mqttutil.WaitToken(ctx, token); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return b
+}
+
+func (b *bridge) AddController(c controller.Controller, handler controller.EventHandler) Bridge {
+	c.SetEventHandler(func(e controller.Event) {
+		switch {
+		case e.Type == controller.EventDeviceAdded, e.Type == controller.EventStateChanged && e.Value == homie.StateReady:
+			b.sync(c.Client(), e.Device.Name(), e.Device.Topic(""), e.Device.Description())
+		case e.Type == controller.EventDeviceRemoved:
+			b.remove(c.Client(), e.Device.Topic(""))
+		}
+		if handler != nil {
+			handler(e)
+		}
+	})
+	return b
+}
+
+// sync publish changed configs of a device and clear configs of removed properties,
+// it does not wait for publishes as it is called from MQTT client goroutines
+func (b *bridge) sync(client homie.MqttAdapter, deviceID string, prefix string, desc *homie.Description) {
+	if client == nil {
+		return
+	}
+	configs, err := Configs(b.config.DiscoveryPrefix, deviceID, prefix, desc)
+	if err != nil {
+		log.Printf("Failed to create Home Assistant configs of device %s: %v", deviceID, err)
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	previous := b.published[prefix]
+	for topic, payload := range configs {
+		if previous[topic] != payload {
+			client.Publish(topic, 1, true, payload)
+		}
+	}
+	for topic := range previous {
+		if _, ok := configs[topic]; !ok {
+			client.Publish(topic, 1, true, "")
+		}
+	}
+	b.published[prefix] = configs
+}
+
+// remove clear all configs of a device, returns tokens of the clearing publishes
+func (b *bridge) remove(client homie.MqttAdapter, prefix string) []mqtt.Token {
+	if client == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var tokens []mqtt.Token
+	for topic := range b.published[prefix] {
+		tokens = append(tokens, client.Publish(topic, 1, true, ""))
+	}
+	delete(b.published, prefix)
+	return tokens
+}
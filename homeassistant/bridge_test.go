@@ -0,0 +1,164 @@
+package homeassistant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/masgari/homie-go/controller"
+	"github.com/masgari/homie-go/homie"
+	"github.com/masgari/homie-go/internal/mqtttest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntity(t *testing.T) {
+	desc := &homie.Description{
+		Homie: homie.HomieSpecVersion4,
+		Name:  "Living room",
+		Nodes: map[string]homie.NodeDescription{
+			"lamp": {Name: "Lamp", Properties: map[string]homie.PropertyDescription{
+				"on":         {Datatype: homie.DataTypeBoolean, Settable: true},
+				"motion":     {Datatype: homie.DataTypeBoolean},
+				"brightness": {Datatype: homie.DataTypeInteger, Format: "0:100", Unit: "%", Settable: true},
+				"power":      {Name: "Power", Datatype: homie.DataTypeFloat, Unit: "W"},
+				"mode":       {Datatype: homie.DataTypeEnum, Format: "day,night", Settable: true},
+				"color":      {Datatype: homie.DataTypeColor, Format: "rgb", Settable: true},
+				"label":      {Datatype: homie.DataTypeString, Settable: true},
+			}},
+		},
+	}
+	components := map[string]string{
+		"on":         ComponentSwitch,
+		"motion":     ComponentBinarySensor,
+		"brightness": ComponentNumber,
+		"power":      ComponentSensor,
+		"mode":       ComponentSelect,
+		"color":      ComponentLight,
+		"label":      ComponentText,
+	}
+	for property, expected := range components {
+		component, _ := Entity("living-room", "homie/living-room/", desc, "lamp", property)
+		assert.Equal(t, expected, component, property)
+	}
+
+	_, cfg := Entity("living-room", "homie/living-room/", desc, "lamp", "brightness")
+	assert.Equal(t, "Lamp brightness", cfg.Name)
+	assert.Equal(t, "homie_living-room_lamp_brightness", cfg.UniqueID)
+	assert.Equal(t, "homie/living-room/lamp/brightness", cfg.StateTopic)
+	assert.Equal(t, "homie/living-room/lamp/brightness/set", cfg.CommandTopic)
+	assert.Equal(t, "homie/living-room/$state", cfg.AvailabilityTopic)
+	assert.Equal(t, 0.0, *cfg.Min)
+	assert.Equal(t, 100.0, *cfg.Max)
+	assert.Equal(t, 1.0, cfg.Step)
+	assert.Equal(t, "%", cfg.UnitOfMeasurement)
+	assert.Equal(t, []string{"homie_living-room"}, cfg.Device.Identifiers)
+
+	_, cfg = Entity("living-room", "homie/living-room/", desc, "lamp", "color")
+	assert.Equal(t, "255,255,255", cfg.PayloadOn)
+	assert.Equal(t, "{{ '0,0,0' if value == '0,0,0' else '255,255,255' }}", cfg.StateValueTemplate)
+
+	_, cfg = Entity("living-room", "homie/living-room/", desc, "lamp", "power")
+	assert.Equal(t, "Lamp Power", cfg.Name)
+	assert.Empty(t, cfg.CommandTopic)
+	assert.Equal(t, "measurement", cfg.StateClass)
+
+	configs, err := Configs("homeassistant/", "living-room", "homie/living-room/", desc)
+	assert.NoError(t, err)
+	assert.Len(t, configs, len(components))
+	assert.Contains(t, configs, "homeassistant/switch/living-room/lamp_on/config")
+
+	_, err = NewBridge(&Config{DiscoveryPrefix: "ha"})
+	assert.True(t, errors.Is(err, homie.ErrInvalidConfig))
+}
+
+func TestBridge(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	b, err := NewBridge(nil)
+	assert.NoError(t, err)
+	d, err := homie.NewDevice("living-room", &homie.Config{
+		Mqtt:      homie.MqttConfig{URL: broker.URL()},
+		BaseTopic: "homie/",
+		Version:   homie.HomieSpecVersion4,
+	})
+	assert.NoError(t, err)
+	n, err := d.NewNode("lamp", "Light")
+	assert.NoError(t, err)
+	_, err = n.NewProperty("on", homie.DataTypeBoolean)
+	assert.NoError(t, err)
+	b.AddDevice(d)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	topic := "homeassistant/binary_sensor/living-room/lamp_on/config"
+	waitConfig(t, broker, topic)
+	payload, _ := broker.Retained(topic)
+	var cfg EntityConfig
+	assert.NoError(t, json.Unmarshal(payload, &cfg))
+	assert.Equal(t, "homie/living-room/lamp/on", cfg.StateTopic)
+
+	// configs of removed nodes are cleared
+	assert.NoError(t, d.RemoveNode("lamp"))
+	assert.True(t, broker.WaitRetained(topic, "", time.Second))
+
+	// remote devices discovered by a controller
+	c, err := controller.New(&controller.Config{Mqtt: homie.MqttConfig{URL: broker.URL()}, BaseTopic: "homie/"})
+	assert.NoError(t, err)
+	b.AddController(c, nil)
+	go c.Run(ctx)
+	broker.Publish("homie/sensor/$homie", []byte(homie.HomieSpecVersion4), true)
+	broker.Publish("homie/sensor/$nodes", []byte("temperature"), true)
+	broker.Publish("homie/sensor/temperature/$properties", []byte("value"), true)
+	broker.Publish("homie/sensor/temperature/value/$datatype", []byte(homie.DataTypeFloat), true)
+	broker.Publish("homie/sensor/$state", []byte(homie.StateReady), true)
+	topic = "homeassistant/sensor/sensor/temperature_value/config"
+	waitConfig(t, broker, topic)
+
+	// configs are removed with device
+	broker.Publish("homie/sensor/$state", nil, true)
+	broker.Publish("homie/sensor/$homie", nil, true)
+	assert.True(t, broker.WaitRetained(topic, "", time.Second))
+}
+
+func TestBridgeWipe(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	b, err := NewBridge(nil)
+	assert.NoError(t, err)
+	d, err := homie.NewDevice("living-room", &homie.Config{
+		Mqtt:      homie.MqttConfig{URL: broker.URL()},
+		BaseTopic: "homie/",
+	})
+	assert.NoError(t, err)
+	n, err := d.NewNode("lamp", "Light")
+	assert.NoError(t, err)
+	_, err = n.NewProperty("on", homie.DataTypeBoolean)
+	assert.NoError(t, err)
+	b.AddDevice(d)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	topic := "homeassistant/binary_sensor/living-room/lamp_on/config"
+	waitConfig(t, broker, topic)
+	assert.NoError(t, d.Wipe(ctx))
+	_, ok := broker.Retained(topic)
+	assert.False(t, ok)
+}
+
+func waitConfig(t *testing.T, broker *mqtttest.Broker, topic string) {
+	for i := 0; i < 100; i++ {
+		if _, ok := broker.Retained(topic); ok {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("no config published to %s", topic)
+}
@@ -0,0 +1,202 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/masgari/homie-go/homie"
+	"github.com/masgari/homie-go/internal/defaults"
+)
+
+// Home Assistant entity components used for Homie properties
+const (
+	ComponentSensor       = "sensor"
+	ComponentBinarySensor = "binary_sensor"
+	ComponentSwitch       = "switch"
+	ComponentNumber       = "number"
+	ComponentSelect       = "select"
+	ComponentText         = "text"
+	ComponentLight        = "light"
+)
+
+// availabilityTemplate device is available only in ready state
+const availabilityTemplate = "{{ 'online' if value == 'ready' else 'offline' }}"
+
+// EntityConfig Home Assistant MQTT discovery payload of an entity
+type EntityConfig struct {
+	Name                 string       `json:"name"`
+	UniqueID             string       `json:"unique_id"`
+	ObjectID             string       `json:"object_id"`
+	StateTopic           string       `json:"state_topic,omitempty"`
+	CommandTopic         string       `json:"command_topic,omitempty"`
+	AvailabilityTopic    string       `json:"availability_topic"`
+	AvailabilityTemplate string       `json:"availability_template"`
+	UnitOfMeasurement    string       `json:"unit_of_measurement,omitempty"`
+	StateClass           string       `json:"state_class,omitempty"`
+	PayloadOn            string       `json:"payload_on,omitempty"`
+	PayloadOff           string       `json:"payload_off,omitempty"`
+	StateValueTemplate   string       `json:"state_value_template,omitempty"`
+	RGBStateTopic        string       `json:"rgb_state_topic,omitempty"`
+	RGBCommandTopic      string       `json:"rgb_command_topic,omitempty"`
+	Min                  *float64     `json:"min,omitempty"`
+	Max                  *float64     `json:"max,omitempty"`
+	Step                 float64      `json:"step,omitempty"`
+	Options              []string     `json:"options,omitempty"`
+	Device               DeviceConfig `json:"device"`
+
+	// read from configs of other integrations, see ReverseBridge
+	ValueTemplate       string               `json:"value_template,omitempty"`
+	CommandTemplate     string               `json:"command_template,omitempty"`
+	StateOn             string               `json:"state_on,omitempty"`
+	StateOff            string               `json:"state_off,omitempty"`
+	PayloadAvailable    string               `json:"payload_available,omitempty"`
+	PayloadNotAvailable string               `json:"payload_not_available,omitempty"`
+	Availability        []AvailabilityConfig `json:"availability,omitempty"`
+	Schema              string               `json:"schema,omitempty"`
+	Retain              bool                 `json:"retain,omitempty"`
+}
+
+// AvailabilityConfig an item of availability list of an entity
+type AvailabilityConfig struct {
+	Topic               string `json:"topic"`
+	ValueTemplate       string `json:"value_template,omitempty"`
+	PayloadAvailable    string `json:"payload_available,omitempty"`
+	PayloadNotAvailable string `json:"payload_not_available,omitempty"`
+}
+
+// DeviceConfig Home Assistant device of an entity, entities of a Homie device are grouped in one device
+type DeviceConfig struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Model        string   `json:"model"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+}
+
+// UnmarshalJSON accept a single identifier string as well as a list
+func (c *DeviceConfig) UnmarshalJSON(data []byte) error {
+	var cfg struct {
+		Identifiers  json.RawMessage `json:"identifiers"`
+		Name         string          `json:"name"`
+		Model        string          `json:"model"`
+		Manufacturer string          `json:"manufacturer"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	*c = DeviceConfig{Name: cfg.Name, Model: cfg.Model, Manufacturer: cfg.Manufacturer}
+	if len(cfg.Identifiers) == 0 {
+		return nil
+	}
+	var id string
+	if err := json.Unmarshal(cfg.Identifiers, &id); err == nil {
+		c.Identifiers = []string{id}
+		return nil
+	}
+	return json.Unmarshal(cfg.Identifiers, &c.Identifiers)
+}
+
+// Entity maps a Homie property to a Home Assistant component and its config, settable properties are mapped to
+// switch, number, select, light or text, others to sensor or binary_sensor
+func Entity(deviceID string, prefix string, desc *homie.Description, nodeID string, propertyID string) (string, EntityConfig) {
+	node := desc.Nodes[nodeID]
+	p := node.Properties[propertyID]
+	topic := prefix + nodeID + "/" + propertyID
+	id := fmt.Sprintf("%s_%s_%s", deviceID, nodeID, propertyID)
+	cfg := EntityConfig{
+		Name:                 strings.TrimSpace(defaults.String(node.Name, nodeID) + " " + defaults.String(p.Name, propertyID)),
+		UniqueID:             "homie_" + id,
+		ObjectID:             strings.Replace(id, "-", "_", -1),
+		StateTopic:           topic,
+		AvailabilityTopic:    prefix + "$state",
+		AvailabilityTemplate: availabilityTemplate,
+		Device: DeviceConfig{
+			Identifiers: []string{"homie_" + deviceID},
+			Name:        defaults.String(desc.Name, deviceID),
+			Model:       "Homie " + desc.Homie,
+		},
+	}
+	if p.Settable {
+		cfg.CommandTopic = topic + "/set"
+	}
+
+	switch p.Datatype {
+	case homie.DataTypeBoolean:
+		cfg.PayloadOn, cfg.PayloadOff = "true", "false"
+		if p.Settable {
+			return ComponentSwitch, cfg
+		}
+		return ComponentBinarySensor, cfg
+	case homie.DataTypeInteger, homie.DataTypeFloat:
+		cfg.UnitOfMeasurement = p.Unit
+		if !p.Settable {
+			cfg.StateClass = "measurement"
+			return ComponentSensor, cfg
+		}
+		cfg.Min, cfg.Max, cfg.Step = numberRange(p.Datatype, p.Format)
+		return ComponentNumber, cfg
+	case homie.DataTypeEnum:
+		if p.Settable {
+			cfg.Options = strings.Split(p.Format, ",")
+			return ComponentSelect, cfg
+		}
+	case homie.DataTypeColor:
+		if p.Settable && p.Format == "rgb" {
+			// color is switched on and off with white and black
+			cfg.PayloadOn, cfg.PayloadOff = "255,255,255", "0,0,0"
+			cfg.StateValueTemplate = "{{ '0,0,0' if value == '0,0,0' else '255,255,255' }}"
+			cfg.RGBStateTopic, cfg.RGBCommandTopic = topic, topic+"/set"
+			return ComponentLight, cfg
+		}
+	}
+	if p.Settable {
+		return ComponentText, cfg
+	}
+	cfg.UnitOfMeasurement = p.Unit
+	return ComponentSensor, cfg
+}
+
+// Configs returns discovery configs of all properties of a device by config topic, prefix is device topic,
+// for example homie/living-room/, discoveryPrefix is Home Assistant discovery prefix, for example homeassistant/
+func Configs(discoveryPrefix string, deviceID string, prefix string, desc *homie.Description) (map[string]string, error) {
+	configs := make(map[string]string)
+	for nodeID, node := range desc.Nodes {
+		for propertyID := range node.Properties {
+			component, cfg := Entity(deviceID, prefix, desc, nodeID, propertyID)
+			payload, err := json.Marshal(cfg)
+			if err != nil {
+				return nil, err
+			}
+			topic := fmt.Sprintf("%s%s/%s/%s_%s/config", discoveryPrefix, component, deviceID, nodeID, propertyID)
+			configs[topic] = string(payload)
+		}
+	}
+	return configs, nil
+}
+
+// numberRange parse min:max[:step] format of a number property, step defaults to 1 for integers and 0.01 for floats
+func numberRange(dataType string, format string) (*float64, *float64, float64) {
+	step := 1.0
+	if dataType == homie.DataTypeFloat {
+		step = 0.01
+	}
+	parts := strings.Split(format, ":")
+	if len(parts) < 2 {
+		return nil, nil, step
+	}
+	var values []*float64
+	for _, part := range parts[:2] {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, nil, step
+		}
+		values = append(values, &v)
+	}
+	if len(parts) > 2 {
+		if v, err := strconv.ParseFloat(parts[2], 64); err == nil && v > 0 {
+			step = v
+		}
+	}
+	return values[0], values[1], step
+}
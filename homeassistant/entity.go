@@ -0,0 +1,247 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/masgari/homie-go/homie"
+	"github.com/masgari/homie-go/internal/defaults"
+)
+
+// abbreviations of discovery payload keys, used by ESPHome and others
+var abbreviations = map[string]string{
+	"avty":         "availability",
+	"avty_t":       "availability_topic",
+	"avty_tpl":     "availability_template",
+	"cmd_t":        "command_topic",
+	"cmd_tpl":      "command_template",
+	"dev":          "device",
+	"obj_id":       "object_id",
+	"ops":          "options",
+	"pl_avail":     "payload_available",
+	"pl_not_avail": "payload_not_available",
+	"pl_on":        "payload_on",
+	"pl_off":       "payload_off",
+	"ret":          "retain",
+	"stat_t":       "state_topic",
+	"stat_on":      "state_on",
+	"stat_off":     "state_off",
+	"stat_cla":     "state_class",
+	"stat_val_tpl": "state_value_template",
+	"uniq_id":      "unique_id",
+	"unit_of_meas": "unit_of_measurement",
+	"val_tpl":      "value_template",
+	"rgb_cmd_t":    "rgb_command_topic",
+	"rgb_stat_t":   "rgb_state_topic",
+	// device
+	"ids": "identifiers",
+	"mf":  "manufacturer",
+	"mdl": "model",
+	// availability
+	"t": "topic",
+}
+
+// ParseEntityConfig parse a discovery payload, abbreviated keys are expanded and '~' is replaced in topics
+func ParseEntityConfig(payload []byte) (EntityConfig, error) {
+	var cfg EntityConfig
+	var raw map[string]interface{}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return cfg, err
+	}
+	base, _ := raw["~"].(string)
+	expanded, err := json.Marshal(expand(raw, base))
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(expanded, &cfg)
+	return cfg, err
+}
+
+// expand expand abbreviated keys of an object and its device and availability items
+func expand(raw map[string]interface{}, base string) map[string]interface{} {
+	result := make(map[string]interface{}, len(raw))
+	for key, value := range raw {
+		if full, ok := abbreviations[key]; ok {
+			key = full
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = expand(v, base)
+		case []interface{}:
+			items := make([]interface{}, len(v))
+			for i, item := range v {
+				if m, ok := item.(map[string]interface{}); ok {
+					item = expand(m, base)
+				}
+				items[i] = item
+			}
+			value = items
+		case string:
+			if base != "" && (key == "topic" || strings.HasSuffix(key, "_topic")) {
+				if strings.HasPrefix(v, "~") {
+					v = base + v[1:]
+				} else if strings.HasSuffix(v, "~") {
+					v = v[:len(v)-1] + base
+				}
+				value = v
+			}
+		}
+		result[key] = value
+	}
+	return result
+}
+
+var (
+	valueTemplate     = regexp.MustCompile(`^\{\{\s*value\s*\}\}$`)
+	valueJSONTemplate = regexp.MustCompile(`^\{\{\s*value_json((?:\.\w+|\[\s*'[^']*'\s*\]|\[\s*"[^"]*"\s*\])+)\s*\}\}$`)
+	valueJSONKey      = regexp.MustCompile(`\.(\w+)|\[\s*'([^']*)'\s*\]|\[\s*"([^"]*)"\s*\]`)
+	commandValue      = regexp.MustCompile(`\{\{\s*value\s*\}\}`)
+)
+
+// RenderValue render a value template with a received payload, only {{ value }} and {{ value_json.key }} templates
+// are supported, returns false if template is not supported or key is not found in payload
+func RenderValue(template string, payload string) (string, bool) {
+	template = strings.TrimSpace(template)
+	if template == "" || valueTemplate.MatchString(template) {
+		return payload, true
+	}
+	match := valueJSONTemplate.FindStringSubmatch(template)
+	if match == nil {
+		return "", false
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(payload), &value); err != nil {
+		return "", false
+	}
+	for _, key := range valueJSONKey.FindAllStringSubmatch(match[1], -1) {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = object[key[1]+key[2]+key[3]]; !ok {
+			return "", false
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// RenderCommand render a command template, {{ value }} is replaced with value
+func RenderCommand(template string, value string) string {
+	if template == "" {
+		return value
+	}
+	return commandValue.ReplaceAllLiteralString(template, value)
+}
+
+// homieProperty returns Homie datatype, format and settable flag of an entity, false if component is not supported
+func homieProperty(component string, cfg EntityConfig) (string, string, bool, bool) {
+	switch component {
+	case ComponentSensor:
+		if cfg.UnitOfMeasurement != "" || cfg.StateClass != "" {
+			return homie.DataTypeFloat, "", false, true
+		}
+		return homie.DataTypeString, "", false, true
+	case ComponentBinarySensor:
+		return homie.DataTypeBoolean, "", false, true
+	case ComponentSwitch, ComponentLight:
+		return homie.DataTypeBoolean, "", true, true
+	case ComponentNumber:
+		// Home Assistant defaults
+		min, max := 1.0, 100.0
+		if cfg.Min != nil {
+			min = *cfg.Min
+		}
+		if cfg.Max != nil {
+			max = *cfg.Max
+		}
+		return homie.DataTypeFloat, homie.RangeFormat(min, max), true, true
+	case ComponentSelect:
+		return homie.DataTypeEnum, homie.EnumFormat(cfg.Options...), true, true
+	case ComponentText:
+		return homie.DataTypeString, "", true, true
+	}
+	return "", "", false, false
+}
+
+// homieValue convert a state payload of an entity to a Homie value
+func homieValue(component string, cfg EntityConfig, payload string) (string, bool) {
+	template := cfg.ValueTemplate
+	if component == ComponentLight {
+		template = cfg.StateValueTemplate
+		if cfg.Schema == "json" {
+			template = "{{ value_json.state }}"
+		}
+	}
+	value, ok := RenderValue(template, payload)
+	if !ok {
+		return "", false
+	}
+	switch component {
+	case ComponentBinarySensor:
+		return booleanValue(value, defaults.String(cfg.PayloadOn, "ON"), defaults.String(cfg.PayloadOff, "OFF"))
+	case ComponentSwitch, ComponentLight:
+		on := defaults.String(cfg.StateOn, defaults.String(cfg.PayloadOn, "ON"))
+		off := defaults.String(cfg.StateOff, defaults.String(cfg.PayloadOff, "OFF"))
+		return booleanValue(value, on, off)
+	}
+	return value, true
+}
+
+// entityCommand convert a Homie value to a command payload of an entity
+func entityCommand(component string, cfg EntityConfig, value string) string {
+	switch component {
+	case ComponentSwitch, ComponentLight:
+		on := value == "true"
+		if component == ComponentLight && cfg.Schema == "json" {
+			if on {
+				return `{"state":"ON"}`
+			}
+			return `{"state":"OFF"}`
+		}
+		if on {
+			value = defaults.String(cfg.PayloadOn, "ON")
+		} else {
+			value = defaults.String(cfg.PayloadOff, "OFF")
+		}
+	}
+	return RenderCommand(cfg.CommandTemplate, value)
+}
+
+func booleanValue(value string, on string, off string) (string, bool) {
+	switch value {
+	case on:
+		return "true", true
+	case off:
+		return "false", true
+	}
+	return "", false
+}
+
+// toID convert a Home Assistant identifier to a Homie ID, invalid characters are replaced with '-'
+func toID(value string) string {
+	var id strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(value) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && id.Len() > 0 {
+				id.WriteByte('-')
+			}
+			id.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return id.String()
+}
@@ -0,0 +1,513 @@
+package homeassistant
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/masgari/homie-go/homie"
+	"github.com/masgari/homie-go/internal/defaults"
+	"github.com/masgari/homie-go/internal/mqttutil"
+)
+
+// settleTime time to wait for more entities of a new device before it is connected,
+// retained configs are received at once and published with the first connect
+const settleTime = 300 * time.Millisecond
+
+// wipeTimeout max time to wipe a device after its last entity is removed
+const wipeTimeout = 10 * time.Second
+
+// stopTimeout max time to publish disconnected state of devices and finish wipes when bridge is stopped
+const stopTimeout = 10 * time.Second
+
+// entityProperty property ID of entities, each entity is a node with one property
+const entityProperty = "state"
+
+// ReverseConfig reverse bridge config
+type ReverseConfig struct {
+	DiscoveryPrefix string // must end with '/', default homeassistant/
+	// Device config of created Homie devices, its Mqtt config is used by the bridge connection which is shared
+	// by devices. Queue.Path is a directory, queue of each device is kept in <device ID>.json. Store is shared by devices
+	Device homie.Config
+}
+
+// ReverseBridge exposes Home Assistant discovered entities as Homie devices. A Homie device is created for each
+// Home Assistant device and a node for each of its entities, with a "state" property. Sensors, binary sensors,
+// switches, lights (on/off), numbers, selects and texts are supported, entities published by Bridge are ignored.
+// State topics are forwarded to property values and Homie set commands to command topics of entities.
+// Devices use the bridge connection, so they have no MQTT will: $state is not set to lost if the bridge dies.
+type ReverseBridge interface {
+	// Run connect to broker with Device.Mqtt.Retry policy and block until ctx is done, devices are stopped afterwards
+	Run(ctx context.Context) error
+	// DeviceNames returns sorted slice of created device IDs
+	DeviceNames() []string
+	GetDevice(name string) homie.Device
+}
+
+type reverseBridge struct {
+	config   *ReverseConfig
+	client   mqtt.Client
+	connects int // number of bridge connects, started devices are initialised once per connect
+	devices  map[string]*haDevice
+	entities map[string]*haEntity          // by discovery topic
+	routes   map[string]map[*haEntity]bool // entities by state and availability topics
+	wiping   map[string]chan struct{}      // by device ID, closed when removed device is wiped
+
+	mutex sync.Mutex
+}
+
+type haDevice struct {
+	device   homie.Device
+	entities map[string]*haEntity
+	started  bool // settle time passed, device is initialised on each bridge connect
+
+	connects     int        // bridge connect device is initialised for
+	connectMutex sync.Mutex // serialise initialising, stopping and wiping device
+}
+
+// sharedClient bridge client shared by created devices, devices do not disconnect it on Stop or Wipe
+type sharedClient struct {
+	mqtt.Client
+}
+
+// IsConnected returns false while client is reconnecting, so messages of devices are queued meanwhile
+func (c sharedClient) IsConnected() bool {
+	return c.Client.IsConnectionOpen()
+}
+
+func (c sharedClient) Disconnect(quiesce uint) {}
+
+// haEntity a discovered entity and its Homie node
+type haEntity struct {
+	topic     string // discovery topic
+	payload   string
+	component string
+	config    EntityConfig
+	device    *haDevice
+	node      homie.Node
+	property  homie.Property
+}
+
+// NewReverseBridge create a reverse bridge
+func NewReverseBridge(cfg *ReverseConfig) (ReverseBridge, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("%w: nil config", homie.ErrInvalidConfig)
+	}
+	if cfg.DiscoveryPrefix == "" {
+		cfg.DiscoveryPrefix = DefaultDiscoveryPrefix
+	}
+	if !strings.HasSuffix(cfg.DiscoveryPrefix, "/") {
+		return nil, fmt.Errorf("%w: discovery prefix must end with '/': %s", homie.ErrInvalidConfig, cfg.DiscoveryPrefix)
+	}
+	if _, err := cfg.Device.Mqtt.ClientOptions(); err != nil {
+		return nil, err
+	}
+	return &reverseBridge{
+		config:   cfg,
+		devices:  make(map[string]*haDevice),
+		entities: make(map[string]*haEntity),
+		routes:   make(map[string]map[*haEntity]bool),
+		wiping:   make(map[string]chan struct{}),
+	}, nil
+}
+
+func (r *reverseBridge) Run(ctx context.Context) error {
+	opts, err := r.config.Device.Mqtt.ClientOptions()
+	if err != nil {
+		return err
+	}
+	opts.SetClientID(fmt.Sprintf("homie-ha-bridge-%x", rand.Int63()))
+	opts.SetAutoReconnect(true)
+	// subscriptions without callback are delivered to default handler
+	opts.SetDefaultPublishHandler(func(client mqtt.Client, message mqtt.Message) {
+		r.onMessage(message.Topic(), message.Payload())
+	})
+	opts.SetOnConnectHandler(r.onConnect)
+
+	client := mqtt.NewClient(opts)
+	r.mutex.Lock()
+	r.client = client
+	r.mutex.Unlock()
+	retry := r.config.Device.Mqtt.Retry
+	err = mqttutil.Retry(ctx, "Home Assistant bridge", retry.MaxAttempts, retry.Backoff, func() error {
+		return mqttutil.WaitToken(ctx, client.Connect())
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			err = fmt.Errorf("%w: %v", homie.ErrConnectFailed, err)
+		}
+		return err
+	}
+	<-ctx.Done()
+	r.stopDevices()
+	client.Disconnect(250)
+	return nil
+}
+
+// stopDevices stop devices and wait for pending wipes, before bridge client is disconnected
+func (r *reverseBridge) stopDevices() {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	r.mutex.Lock()
+	devices := make([]*haDevice, 0, len(r.devices))
+	for _, d := range r.devices {
+		devices = append(devices, d)
+	}
+	wiping := make([]chan struct{}, 0, len(r.wiping))
+	for _, wiped := range r.wiping {
+		wiping = append(wiping, wiped)
+	}
+	r.mutex.Unlock()
+	var wg sync.WaitGroup
+	for _, d := range devices {
+		wg.Add(1)
+		go func(d *haDevice) {
+			defer wg.Done()
+			d.connectMutex.Lock()
+			defer d.connectMutex.Unlock()
+			if err := d.device.Stop(ctx); err != nil {
+				log.Printf("Failed to stop device %s: %v", d.device.Name(), err)
+			}
+		}(d)
+	}
+	wg.Wait()
+	for _, wiped := range wiping {
+		select {
+		case <-wiped:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *reverseBridge) DeviceNames() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	names := make([]string, 0, len(r.devices))
+	for name := range r.devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *reverseBridge) GetDevice(name string) homie.Device {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if d, ok := r.devices[name]; ok {
+		return d.device
+	}
+	return nil
+}
+
+// onConnect subscribe discovery topics and topics of known entities and initialise started devices,
+// called on each connect
+func (r *reverseBridge) onConnect(client mqtt.Client) {
+	client.Subscribe(r.config.DiscoveryPrefix+"#", 1, nil)
+	r.mutex.Lock()
+	r.connects++
+	for topic := range r.routes {
+		client.Subscribe(topic, 1, nil)
+	}
+	devices := make([]*haDevice, 0, len(r.devices))
+	for _, d := range r.devices {
+		if d.started {
+			devices = append(devices, d)
+		}
+	}
+	r.mutex.Unlock()
+	for _, d := range devices {
+		go r.connectDevice(d)
+	}
+}
+
+// connectDevice initialise a device with the shared bridge client, once per bridge connect
+func (r *reverseBridge) connectDevice(d *haDevice) {
+	d.connectMutex.Lock()
+	defer d.connectMutex.Unlock()
+	r.mutex.Lock()
+	client, connects := r.client, r.connects
+	current := r.devices[d.device.Name()] == d
+	r.mutex.Unlock()
+	if !current || client == nil || connects == d.connects || !client.IsConnectionOpen() {
+		return
+	}
+	d.connects = connects
+	if err := d.device.OnConnect(sharedClient{client}); err != nil {
+		log.Printf("Failed to initialise device %s: %v", d.device.Name(), err)
+	}
+}
+
+func (r *reverseBridge) onMessage(topic string, payload []byte) {
+	if strings.HasPrefix(topic, r.config.DiscoveryPrefix) && strings.HasSuffix(topic, "/config") {
+		r.onConfig(topic, payload)
+		return
+	}
+	r.mutex.Lock()
+	entities := make([]*haEntity, 0, len(r.routes[topic]))
+	for e := range r.routes[topic] {
+		entities = append(entities, e)
+	}
+	r.mutex.Unlock()
+	for _, e := range entities {
+		e.onMessage(topic, string(payload))
+	}
+}
+
+// onConfig add, update or remove an entity
+func (r *reverseBridge) onConfig(topic string, payload []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	old := r.entities[topic]
+	if old != nil && old.payload == string(payload) {
+		return
+	}
+	if old != nil {
+		r.removeEntity(old)
+	}
+	if len(payload) == 0 {
+		return
+	}
+	// <prefix><component>/[<node_id>/]<object_id>/config
+	parts := strings.Split(strings.TrimPrefix(topic, r.config.DiscoveryPrefix), "/")
+	if len(parts) < 3 || len(parts) > 4 {
+		return
+	}
+	cfg, err := ParseEntityConfig(payload)
+	if err != nil {
+		log.Printf("Invalid Home Assistant config %s: %v", topic, err)
+		return
+	}
+	// published by Bridge, do not bridge back
+	if strings.HasPrefix(cfg.UniqueID, "homie_") {
+		return
+	}
+	e := &haEntity{topic: topic, payload: string(payload), component: parts[0], config: cfg}
+	deviceID := parts[len(parts)-2]
+	if len(parts) == 4 {
+		deviceID = parts[1]
+	}
+	if len(cfg.Device.Identifiers) > 0 {
+		deviceID = cfg.Device.Identifiers[0]
+	}
+	nodeID := defaults.String(cfg.ObjectID, parts[len(parts)-2])
+	if err := r.addEntity(e, toID(deviceID), toID(nodeID)); err != nil {
+		log.Printf("Failed to bridge Home Assistant entity %s: %v", topic, err)
+	}
+}
+
+// addEntity add entity as a node of its device, device is created if needed, called with lock held
+func (r *reverseBridge) addEntity(e *haEntity, deviceID string, nodeID string) error {
+	dataType, format, settable, ok := homieProperty(e.component, e.config)
+	if !ok {
+		return fmt.Errorf("unsupported component %s", e.component)
+	}
+	d := r.devices[deviceID]
+	if d == nil {
+		device, err := homie.NewDevice(deviceID, r.deviceConfig(deviceID))
+		if err != nil {
+			return err
+		}
+		device.SetFriendlyName(defaults.String(e.config.Device.Name, deviceID))
+		d = &haDevice{device: device, entities: make(map[string]*haEntity)}
+		r.devices[deviceID] = d
+		time.AfterFunc(settleTime, func() {
+			r.startDevice(d)
+		})
+	}
+	if d.device.GetNode(nodeID) != nil {
+		// same object ID in different components
+		nodeID = nodeID + "-" + toID(e.component)
+	}
+
+	n := homie.NewNode(nodeID, e.component)
+	n.SetFriendlyName(defaults.String(e.config.Name, d.device.FriendlyName()))
+	p, err := n.NewProperty(entityProperty, dataType)
+	if err != nil {
+		return err
+	}
+	p.SetFormat(format).SetUnit(e.config.UnitOfMeasurement)
+	if settable {
+		p.SetHandler(func(p homie.Property, payload []byte, topic string) (bool, error) {
+			return true, r.command(e, string(payload))
+		})
+	}
+	if _, err := d.device.AddNode(n); err != nil {
+		return err
+	}
+	e.device, e.node, e.property = d, n, p
+	d.entities[e.topic] = e
+	r.entities[e.topic] = e
+	for _, topic := range e.topics() {
+		r.route(topic, e)
+	}
+	return nil
+}
+
+// deviceConfig returns config of a created device, each device has its own queue file
+func (r *reverseBridge) deviceConfig(deviceID string) *homie.Config {
+	cfg := r.config.Device
+	if cfg.Queue.Path != "" {
+		cfg.Queue.Path = filepath.Join(cfg.Queue.Path, deviceID+".json")
+	}
+	return &cfg
+}
+
+// removeEntity remove node of entity, device is wiped when its last entity is removed, called with lock held
+func (r *reverseBridge) removeEntity(e *haEntity) {
+	delete(r.entities, e.topic)
+	delete(e.device.entities, e.topic)
+	for _, topic := range e.topics() {
+		r.unroute(topic, e)
+	}
+	if len(e.device.entities) > 0 {
+		if err := e.device.device.RemoveNode(e.node.Name()); err != nil {
+			log.Printf("Failed to remove node %s: %v", e.node.Name(), err)
+		}
+		return
+	}
+	device := e.device.device
+	delete(r.devices, device.Name())
+	wiped := make(chan struct{})
+	r.wiping[device.Name()] = wiped
+	go func(d *haDevice) {
+		defer close(wiped)
+		ctx, cancel := context.WithTimeout(context.Background(), wipeTimeout)
+		defer cancel()
+		d.connectMutex.Lock()
+		if err := device.Wipe(ctx); err != nil {
+			log.Printf("Failed to wipe device %s: %v", device.Name(), err)
+			// bridge is not connected, close publishers
+			if err := device.Stop(ctx); err != nil {
+				log.Printf("Failed to stop device %s: %v", device.Name(), err)
+			}
+		}
+		d.connectMutex.Unlock()
+		r.mutex.Lock()
+		if r.wiping[device.Name()] == wiped {
+			delete(r.wiping, device.Name())
+		}
+		r.mutex.Unlock()
+	}(e.device)
+}
+
+// startDevice initialise a device now and on each bridge connect, unless it is removed meanwhile,
+// a removed device with same ID is wiped first
+func (r *reverseBridge) startDevice(d *haDevice) {
+	r.mutex.Lock()
+	wiped := r.wiping[d.device.Name()]
+	r.mutex.Unlock()
+	if wiped != nil {
+		<-wiped
+	}
+	r.mutex.Lock()
+	current := r.devices[d.device.Name()] == d
+	d.started = current
+	r.mutex.Unlock()
+	if current {
+		r.connectDevice(d)
+	}
+}
+
+// route subscribe a topic for an entity, called with lock held
+func (r *reverseBridge) route(topic string, e *haEntity) {
+	entities, ok := r.routes[topic]
+	if !ok {
+		entities = make(map[*haEntity]bool)
+		r.routes[topic] = entities
+		if r.client != nil && r.client.IsConnectionOpen() {
+			r.client.Subscribe(topic, 1, nil)
+		}
+	}
+	entities[e] = true
+}
+
+// unroute unsubscribe a topic of an entity if no other entity uses it, called with lock held
+func (r *reverseBridge) unroute(topic string, e *haEntity) {
+	delete(r.routes[topic], e)
+	if len(r.routes[topic]) > 0 {
+		return
+	}
+	delete(r.routes, topic)
+	if r.client != nil && r.client.IsConnectionOpen() {
+		r.client.Unsubscribe(topic)
+	}
+}
+
+// command publish a Homie set command to command topic of entity, without a state topic the value is
+// published directly
+func (r *reverseBridge) command(e *haEntity, value string) error {
+	r.mutex.Lock()
+	client := r.client
+	r.mutex.Unlock()
+	if client == nil || !client.IsConnectionOpen() {
+		return fmt.Errorf("%w: bridge", homie.ErrNotConnected)
+	}
+	client.Publish(e.config.CommandTopic, 1, e.config.Retain, entityCommand(e.component, e.config, value))
+	if e.config.StateTopic == "" {
+		e.property.SetValue(value).Publish()
+	}
+	return nil
+}
+
+// topics returns state and availability topics of entity
+func (e *haEntity) topics() []string {
+	var topics []string
+	if e.config.StateTopic != "" {
+		topics = append(topics, e.config.StateTopic)
+	}
+	if e.config.AvailabilityTopic != "" {
+		topics = append(topics, e.config.AvailabilityTopic)
+	}
+	for _, a := range e.config.Availability {
+		topics = append(topics, a.Topic)
+	}
+	return topics
+}
+
+// onMessage update property value or device state
+func (e *haEntity) onMessage(topic string, payload string) {
+	if topic == e.config.StateTopic {
+		if value, ok := homieValue(e.component, e.config, payload); ok {
+			e.property.SetValue(value)
+			if client := e.device.device.Client(); client != nil && client.IsConnected() {
+				e.property.Publish()
+			}
+		}
+	}
+	if topic == e.config.AvailabilityTopic {
+		e.setAvailability(e.config.AvailabilityTemplate, e.config.PayloadAvailable, e.config.PayloadNotAvailable, payload)
+	}
+	for _, a := range e.config.Availability {
+		if topic == a.Topic {
+			e.setAvailability(a.ValueTemplate, a.PayloadAvailable, a.PayloadNotAvailable, payload)
+		}
+	}
+}
+
+// setAvailability set device state to ready or disconnected
+func (e *haEntity) setAvailability(template string, available string, notAvailable string, payload string) {
+	value, ok := RenderValue(template, payload)
+	if !ok {
+		return
+	}
+	state := ""
+	switch value {
+	case defaults.String(available, "online"):
+		state = homie.StateReady
+	case defaults.String(notAvailable, "offline"):
+		state = homie.StateDisconnected
+	}
+	if state != "" && e.device.device.State() != state {
+		if err := e.device.device.SetState(state); err != nil {
+			log.Printf("Failed to set state of device %s: %v", e.device.device.Name(), err)
+		}
+	}
+}
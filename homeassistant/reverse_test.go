@@ -0,0 +1,128 @@
+package homeassistant
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/masgari/homie-go/homie"
+	"github.com/masgari/homie-go/internal/mqtttest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEntityConfig(t *testing.T) {
+	cfg, err := ParseEntityConfig([]byte(`{"~":"esp/relay","name":"Relay","stat_t":"~/state","cmd_t":"~/command",
+		"pl_on":"1","pl_off":"0","avty":[{"t":"~/status"}],"dev":{"ids":"esp-1","name":"ESP"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "esp/relay/state", cfg.StateTopic)
+	assert.Equal(t, "esp/relay/command", cfg.CommandTopic)
+	assert.Equal(t, "1", cfg.PayloadOn)
+	assert.Equal(t, "esp/relay/status", cfg.Availability[0].Topic)
+	assert.Equal(t, []string{"esp-1"}, cfg.Device.Identifiers)
+
+	value, ok := RenderValue("{{ value_json.temperature }}", `{"temperature":21.5,"humidity":40}`)
+	assert.True(t, ok)
+	assert.Equal(t, "21.5", value)
+	value, ok = RenderValue("{{ value_json['state'] }}", `{"state":"ON"}`)
+	assert.True(t, ok)
+	assert.Equal(t, "ON", value)
+	_, ok = RenderValue("{{ value_json.missing }}", `{"state":"ON"}`)
+	assert.False(t, ok)
+	_, ok = RenderValue("{{ value | float }}", "1")
+	assert.False(t, ok)
+	assert.Equal(t, `{"brightness": 70}`, RenderCommand(`{"brightness": {{ value }}}`, "70"))
+	assert.Equal(t, "zigbee2mqtt-0x00158d0001", toID("zigbee2mqtt_0x00158D0001"))
+
+	_, err = NewReverseBridge(&ReverseConfig{DiscoveryPrefix: "ha"})
+	assert.True(t, errors.Is(err, homie.ErrInvalidConfig))
+
+	// nothing listens on port 1
+	r, err := NewReverseBridge(&ReverseConfig{Device: homie.Config{Mqtt: homie.MqttConfig{
+		URL:   "tcp://127.0.0.1:1",
+		Retry: homie.RetryPolicy{MaxAttempts: 2, InitialInterval: 10 * time.Millisecond},
+	}}})
+	assert.NoError(t, err)
+	err = r.Run(context.Background())
+	assert.True(t, errors.Is(err, homie.ErrConnectFailed), "%v", err)
+	assert.Contains(t, err.Error(), "after 2 attempts")
+}
+
+func TestReverseBridge(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	device := `"device":{"identifiers":["zigbee2mqtt_0x0001"],"name":"Kitchen"}`
+	temperature := []byte(`{"name":"Temperature",
+		"state_topic":"zigbee2mqtt/kitchen","value_template":"{{ value_json.temperature }}","unit_of_measurement":"°C",
+		"object_id":"kitchen_temperature",` + device + `}`)
+	broker.Publish("homeassistant/sensor/0x0001/temperature/config", temperature, true)
+	broker.Publish("homeassistant/switch/0x0001/plug/config", []byte(`{"name":"Plug","state_topic":"zigbee2mqtt/kitchen",
+		"value_template":"{{ value_json.state }}","command_topic":"zigbee2mqtt/kitchen/set","retain":true,
+		"command_template":"{\"state\": \"{{ value }}\"}","object_id":"kitchen_plug",`+device+`}`), true)
+	broker.Publish("zigbee2mqtt/kitchen", []byte(`{"temperature":21.5,"state":"OFF"}`), true)
+
+	dir, err := ioutil.TempDir("", "homie-ha-queue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	r, err := NewReverseBridge(&ReverseConfig{Device: homie.Config{
+		Mqtt:      homie.MqttConfig{URL: broker.URL()},
+		BaseTopic: "homie/",
+		Version:   homie.HomieSpecVersion4,
+		Queue:     homie.QueueConfig{Size: 10, Path: dir},
+	}})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	assert.True(t, broker.WaitRetained("homie/zigbee2mqtt-0x0001/$state", homie.StateReady, 2*time.Second))
+	assert.Equal(t, []string{"zigbee2mqtt-0x0001"}, r.DeviceNames())
+	d := r.GetDevice("zigbee2mqtt-0x0001")
+	assert.Equal(t, "Kitchen", d.FriendlyName())
+	assert.Equal(t, filepath.Join(dir, "zigbee2mqtt-0x0001.json"), d.Config().Queue.Path)
+	assert.Equal(t, []string{"kitchen-plug", "kitchen-temperature"}, d.NodeNames())
+	// devices share the bridge connection
+	assert.Equal(t, 1, broker.ClientCount())
+	assert.True(t, broker.WaitRetained("homie/zigbee2mqtt-0x0001/kitchen-temperature/state", "21.5", time.Second))
+	assert.True(t, broker.WaitRetained("homie/zigbee2mqtt-0x0001/kitchen-temperature/state/$unit", "°C", time.Second))
+	assert.True(t, broker.WaitRetained("homie/zigbee2mqtt-0x0001/kitchen-plug/state", "false", time.Second))
+	assert.True(t, broker.WaitRetained("homie/zigbee2mqtt-0x0001/kitchen-plug/state/$settable", "true", time.Second))
+
+	// state topic is forwarded to property value
+	broker.Publish("zigbee2mqtt/kitchen", []byte(`{"temperature":22,"state":"OFF"}`), true)
+	assert.True(t, broker.WaitRetained("homie/zigbee2mqtt-0x0001/kitchen-temperature/state", "22", time.Second))
+
+	// Homie set command is forwarded to command topic
+	broker.Publish("homie/zigbee2mqtt-0x0001/kitchen-plug/state/set", []byte("true"), false)
+	assert.True(t, broker.WaitRetained("zigbee2mqtt/kitchen/set", `{"state": "ON"}`, time.Second))
+
+	// removed entities are removed from device, device is wiped with its last entity
+	broker.Publish("homeassistant/switch/0x0001/plug/config", nil, true)
+	assert.True(t, broker.WaitRetained("homie/zigbee2mqtt-0x0001/$nodes", "kitchen-temperature", time.Second))
+	broker.Publish("homeassistant/sensor/0x0001/temperature/config", nil, true)
+	assert.True(t, broker.WaitRetained("homie/zigbee2mqtt-0x0001/$state", "", 2*time.Second))
+	assert.Empty(t, r.DeviceNames())
+
+	// device removed and created again before it is wiped
+	broker.Publish("homeassistant/sensor/0x0001/temperature/config", temperature, true)
+	assert.True(t, broker.WaitRetained("homie/zigbee2mqtt-0x0001/$state", homie.StateReady, 2*time.Second))
+	broker.Publish("homeassistant/sensor/0x0001/temperature/config", nil, true)
+	broker.Publish("homeassistant/sensor/0x0001/temperature/config", temperature, true)
+	time.Sleep(time.Second)
+	assert.True(t, broker.WaitRetained("homie/zigbee2mqtt-0x0001/$state", homie.StateReady, time.Second))
+	assert.True(t, broker.WaitRetained("homie/zigbee2mqtt-0x0001/kitchen-temperature/state", "22", time.Second))
+
+	// devices are published again when bridge reconnects
+	broker.Publish("homie/zigbee2mqtt-0x0001/$state", nil, true)
+	broker.DropClients()
+	assert.True(t, broker.WaitRetained("homie/zigbee2mqtt-0x0001/$state", homie.StateReady, 5*time.Second))
+
+	// devices are stopped with bridge
+	cancel()
+	assert.True(t, broker.WaitRetained("homie/zigbee2mqtt-0x0001/$state", homie.StateDisconnected, 2*time.Second))
+}
@@ -1,16 +1,253 @@
 package homie
 
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/url"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
 // MqttConfig broker config
 type MqttConfig struct {
 	Host     string
 	Port     int
+	URL      string   // broker URL with tcp, ssl, tls, ws or wss scheme, for example ssl://broker:8883, overrides Host and Port
+	Brokers  []string // broker URLs in failover order, overrides URL, Host and Port
 	Username string
 	Password string
+	TLS      TLSConfig
+
+	// PersistentSession keep session on broker between connections, subscriptions are restored by broker on reconnect
+	PersistentSession bool
+
+	ConnectTimeout       time.Duration // timeout of each connect attempt, default 30s
+	MaxReconnectInterval time.Duration // max wait between reconnect rounds after connection is lost, default 10m
+	PublishTimeout       time.Duration // max wait for delivery of a published message, default 10s
+	Retry                RetryPolicy   // initial connect retry policy, an attempt is a round of trying all brokers
+}
+
+// TLSConfig TLS settings for ssl, tls and wss broker URLs
+type TLSConfig struct {
+	CAFile             string // PEM CA bundle to verify broker certificate, system roots are used if empty
+	CertFile           string // PEM client certificate for mutual TLS
+	KeyFile            string // PEM client private key for mutual TLS
+	ServerName         string // overrides host name used to verify broker certificate
+	InsecureSkipVerify bool   // do not verify broker certificate, do not use in production
+}
+
+func (t TLSConfig) isEmpty() bool {
+	return t == TLSConfig{}
+}
+
+// tlsConfig load certificates and create tls.Config, returns nil if there is no TLS setting
+func (t TLSConfig) tlsConfig() (*tls.Config, error) {
+	if t.isEmpty() {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		ca, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%w: no certificate found in %s", ErrInvalidConfig, t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// brokerURLs returns Brokers if set, otherwise URL or tcp://Host:Port
+func (m MqttConfig) brokerURLs() ([]*url.URL, error) {
+	raws := m.Brokers
+	if len(raws) == 0 {
+		raw := m.URL
+		if raw == "" {
+			raw = fmt.Sprintf("tcp://%s:%d", m.Host, m.Port)
+		}
+		raws = []string{raw}
+	}
+	brokers := make([]*url.URL, 0, len(raws))
+	for _, raw := range raws {
+		broker, err := parseBrokerURL(raw)
+		if err != nil {
+			return nil, err
+		}
+		brokers = append(brokers, broker)
+	}
+	return brokers, nil
+}
+
+func parseBrokerURL(raw string) (*url.URL, error) {
+	broker, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	switch broker.Scheme {
+	case "tcp", "ssl", "tls", "tcps", "ws", "wss":
+	default:
+		return nil, fmt.Errorf("%w: unsupported broker URL scheme: %s", ErrInvalidConfig, broker.Scheme)
+	}
+	if broker.Host == "" {
+		return nil, fmt.Errorf("%w: broker URL without host: %s", ErrInvalidConfig, raw)
+	}
+	return broker, nil
+}
+
+// ClientOptions returns paho client options with brokers, credentials, TLS and connect timeout of config,
+// it can be used to connect other clients, for example controllers, to the same brokers
+func (m MqttConfig) ClientOptions() (*mqtt.ClientOptions, error) {
+	brokers, err := m.brokerURLs()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := m.TLS.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	opts := mqtt.NewClientOptions()
+	opts.Servers = brokers
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	opts.SetUsername(m.Username)
+	opts.SetPassword(m.Password)
+	if m.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(m.ConnectTimeout)
+	}
+	return opts, nil
+}
+
+// reconnectPolicy retry policy after connection is lost, retries until device is stopped
+func (m MqttConfig) reconnectPolicy() RetryPolicy {
+	maxInterval := m.MaxReconnectInterval
+	if maxInterval <= 0 {
+		maxInterval = 10 * time.Minute
+	}
+	return RetryPolicy{
+		InitialInterval: m.Retry.InitialInterval,
+		MaxInterval:     maxInterval,
+		Multiplier:      m.Retry.Multiplier,
+		Jitter:          m.Retry.Jitter,
+	}
+}
+
+// RetryPolicy initial connect retry policy, wait time between attempts grows exponentially with some jitter
+type RetryPolicy struct {
+	MaxAttempts     int           // 0 means retry until context is done
+	InitialInterval time.Duration // default 1s
+	MaxInterval     time.Duration // default 1m
+	Multiplier      float64       // default 2
+	Jitter          float64       // randomisation factor between 0 and 1, 0.2 means ±20% of interval
+}
+
+// Backoff returns wait time after a failed attempt, attempt starts from 1
+func (r RetryPolicy) Backoff(attempt int) time.Duration {
+	initial, max, multiplier := r.InitialInterval, r.MaxInterval, r.Multiplier
+	if initial <= 0 {
+		initial = time.Second
+	}
+	if max <= 0 {
+		max = time.Minute
+	}
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	interval := float64(initial) * math.Pow(multiplier, float64(attempt-1))
+	if interval > float64(max) {
+		interval = float64(max)
+	}
+	if r.Jitter > 0 {
+		interval += interval * r.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(interval)
 }
 
 // Config homie config
 type Config struct {
-	Mqtt                MqttConfig
-	BaseTopic           string // must end with '/'
-	StatsReportInterval int // in seconds
+	Mqtt                 MqttConfig
+	BaseTopic            string      // must end with '/'
+	StatsReportInterval  int         // in seconds
+	Version              string      // Homie convention version: HomieSpecVersion (default), HomieSpecVersion4 or HomieSpecVersion5
+	Extensions           []string    // Homie 4.0 and 5 extensions, for example ExtensionLegacyStats
+	CleanupStaleTopics   bool        // on first connect clear retained device topics which are not part of current nodes and properties
+	RestoreValues        bool        // on first connect set empty property values from retained property topics
+	RestoreCallsHandlers bool        // call handlers of settable properties with restored values, to re-apply them
+	Store                StateStore  // persists values of persistent properties, see NewFileStore and NewBoltStore
+	Queue                QueueConfig // queue messages while disconnected, disabled by default
+}
+
+func (c *Config) validate() error {
+	if c == nil {
+		return fmt.Errorf("%w: nil config", ErrInvalidConfig)
+	}
+	switch c.specVersion() {
+	case HomieSpecVersion, HomieSpecVersion4, HomieSpecVersion5:
+	default:
+		return fmt.Errorf("%w: unsupported Homie version %s", ErrInvalidConfig, c.Version)
+	}
+	if c.BaseTopic != "" && !strings.HasSuffix(c.BaseTopic, "/") {
+		return fmt.Errorf("%w: base topic must end with '/': %s", ErrInvalidConfig, c.BaseTopic)
+	}
+	if c.Mqtt.URL != "" || len(c.Mqtt.Brokers) > 0 {
+		if _, err := c.Mqtt.brokerURLs(); err != nil {
+			return err
+		}
+	}
+	switch c.Queue.DropPolicy {
+	case "", DropOldest, DropNewest:
+	default:
+		return fmt.Errorf("%w: invalid drop policy %s", ErrInvalidConfig, c.Queue.DropPolicy)
+	}
+	if c.Mqtt.Retry.MaxAttempts < 0 || c.Mqtt.Retry.Jitter < 0 || c.Mqtt.Retry.Jitter > 1 {
+		return fmt.Errorf("%w: invalid retry policy", ErrInvalidConfig)
+	}
+	return nil
+}
+
+func (c *Config) specVersion() string {
+	if c.Version == "" {
+		return HomieSpecVersion
+	}
+	return c.Version
+}
+
+func (c *Config) isVersion4() bool {
+	return c.specVersion() == HomieSpecVersion4
+}
+
+func (c *Config) isVersion5() bool {
+	return c.specVersion() == HomieSpecVersion5
+}
+
+// hasExtension check if an extension is enabled, legacy extensions are always enabled before Homie 4.0
+func (c *Config) hasExtension(extension string) bool {
+	if c.specVersion() == HomieSpecVersion {
+		return extension == ExtensionLegacyStats || extension == ExtensionLegacyFirmware
+	}
+	id := strings.SplitN(extension, ":", 2)[0]
+	for _, e := range c.Extensions {
+		if strings.SplitN(e, ":", 2)[0] == id {
+			return true
+		}
+	}
+	return false
 }
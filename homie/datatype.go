@@ -0,0 +1,146 @@
+package homie
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Homie property datatypes
+const (
+	DataTypeInteger  = "integer"
+	DataTypeFloat    = "float"
+	DataTypeBoolean  = "boolean"
+	DataTypeString   = "string"
+	DataTypeEnum     = "enum"
+	DataTypeColor    = "color"
+	DataTypeDatetime = "datetime"
+	DataTypeDuration = "duration"
+)
+
+// Color formats
+const (
+	ColorFormatRGB = "rgb"
+	ColorFormatHSV = "hsv"
+)
+
+// ISO 8601 duration, for example PT12H5M46S
+var durationPattern = regexp.MustCompile(`^P(?:\d+(?:\.\d+)?D)?(?:T(?:\d+(?:\.\d+)?H)?(?:\d+(?:\.\d+)?M)?(?:\d+(?:\.\d+)?S)?)?$`)
+
+// RangeFormat returns $format for integer and float properties, for example "0:100"
+func RangeFormat(from, to float64) string {
+	return fmt.Sprintf("%s:%s", strconv.FormatFloat(from, 'f', -1, 64), strconv.FormatFloat(to, 'f', -1, 64))
+}
+
+// EnumFormat returns $format for enum properties, for example "low,medium,high"
+func EnumFormat(values ...string) string {
+	return strings.Join(values, ",")
+}
+
+// IsValidDataType returns true if dataType is one of Homie datatypes
+func IsValidDataType(dataType string) bool {
+	switch dataType {
+	case DataTypeInteger, DataTypeFloat, DataTypeBoolean, DataTypeString,
+		DataTypeEnum, DataTypeColor, DataTypeDatetime, DataTypeDuration:
+		return true
+	}
+	return false
+}
+
+// ValidateValue check a payload against property datatype and format
+func ValidateValue(dataType string, format string, value string) error {
+	switch dataType {
+	case DataTypeInteger:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid integer: %q", ErrInvalidValue, value)
+		}
+		return validateRange(format, float64(v), value)
+	case DataTypeFloat:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid float: %q", ErrInvalidValue, value)
+		}
+		return validateRange(format, v, value)
+	case DataTypeBoolean:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("%w: invalid boolean: %q", ErrInvalidValue, value)
+		}
+	case DataTypeString, "":
+	case DataTypeEnum:
+		for _, item := range strings.Split(format, ",") {
+			if item == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %q is not one of: %s", ErrInvalidValue, value, format)
+	case DataTypeColor:
+		return validateColor(format, value)
+	case DataTypeDatetime:
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return fmt.Errorf("%w: invalid datetime: %q", ErrInvalidValue, value)
+		}
+	case DataTypeDuration:
+		if value == "P" || value == "PT" || !durationPattern.MatchString(value) {
+			return fmt.Errorf("%w: invalid duration: %q", ErrInvalidValue, value)
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidDataType, dataType)
+	}
+	return nil
+}
+
+// validateRange check value against from:to format, both ends are optional
+func validateRange(format string, v float64, value string) error {
+	if format == "" {
+		return nil
+	}
+	parts := strings.SplitN(format, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid range format: %q", format)
+	}
+	if parts[0] != "" {
+		from, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return fmt.Errorf("invalid range format: %q", format)
+		}
+		if v < from {
+			return fmt.Errorf("%w: %s is less than %s", ErrInvalidValue, value, parts[0])
+		}
+	}
+	if parts[1] != "" {
+		to, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return fmt.Errorf("invalid range format: %q", format)
+		}
+		if v > to {
+			return fmt.Errorf("%w: %s is greater than %s", ErrInvalidValue, value, parts[1])
+		}
+	}
+	return nil
+}
+
+func validateColor(format string, value string) error {
+	var limits []int
+	switch format {
+	case ColorFormatRGB:
+		limits = []int{255, 255, 255}
+	case ColorFormatHSV:
+		limits = []int{360, 100, 100}
+	default:
+		return fmt.Errorf("invalid color format: %q", format)
+	}
+	parts := strings.Split(value, ",")
+	if len(parts) != len(limits) {
+		return fmt.Errorf("%w: invalid %s color: %q", ErrInvalidValue, format, value)
+	}
+	for i, part := range parts {
+		c, err := strconv.Atoi(part)
+		if err != nil || c < 0 || c > limits[i] {
+			return fmt.Errorf("%w: invalid %s color: %q", ErrInvalidValue, format, value)
+		}
+	}
+	return nil
+}
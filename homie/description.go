@@ -0,0 +1,85 @@
+package homie
+
+import (
+	"encoding/json"
+	"hash/fnv"
+)
+
+// Description Homie 5 device description, published as $description
+type Description struct {
+	Homie      string                     `json:"homie"`
+	Version    int64                      `json:"version"`
+	Name       string                     `json:"name,omitempty"`
+	Extensions []string                   `json:"extensions,omitempty"`
+	Nodes      map[string]NodeDescription `json:"nodes,omitempty"`
+}
+
+// NodeDescription node part of Homie 5 device description
+type NodeDescription struct {
+	Name       string                         `json:"name,omitempty"`
+	Type       string                         `json:"type,omitempty"`
+	Properties map[string]PropertyDescription `json:"properties,omitempty"`
+}
+
+// PropertyDescription property part of Homie 5 device description
+type PropertyDescription struct {
+	Name     string `json:"name,omitempty"`
+	Datatype string `json:"datatype"`
+	Format   string `json:"format,omitempty"`
+	Settable bool   `json:"settable"`
+	Retained bool   `json:"retained"`
+	Unit     string `json:"unit,omitempty"`
+}
+
+// ParseDescription parse a $description payload
+func ParseDescription(payload []byte) (*Description, error) {
+	desc := &Description{}
+	if err := json.Unmarshal(payload, desc); err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
+
+// JSON returns the description as a JSON document, if Version is zero it will be set to a hash of the description
+func (desc *Description) JSON() ([]byte, error) {
+	if desc.Version == 0 {
+		payload, err := json.Marshal(desc)
+		if err != nil {
+			return nil, err
+		}
+		h := fnv.New32a()
+		h.Write(payload)
+		desc.Version = int64(h.Sum32())
+	}
+	return json.Marshal(desc)
+}
+
+func describeDevice(d Device) *Description {
+	desc := &Description{
+		Homie:      d.Config().specVersion(),
+		Name:       d.FriendlyName(),
+		Extensions: d.Config().Extensions,
+		Nodes:      make(map[string]NodeDescription),
+	}
+	for _, nodeName := range d.NodeNames() {
+		n := d.GetNode(nodeName)
+		nodeDesc := NodeDescription{
+			Name:       n.FriendlyName(),
+			Type:       n.Type(),
+			Properties: make(map[string]PropertyDescription),
+		}
+		for _, propName := range n.PropertyNames() {
+			p := n.GetProperty(propName)
+			nodeDesc.Properties[propName] = PropertyDescription{
+				Name:     p.FriendlyName(),
+				Datatype: p.Type(),
+				Format:   p.Format(),
+				Settable: p.Settable(),
+				Retained: p.Retained(),
+				Unit:     p.Unit(),
+			}
+		}
+		desc.Nodes[nodeName] = nodeDesc
+	}
+	return desc
+}
@@ -1,51 +1,173 @@
 package homie
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/masgari/homie-go/internal/mqttutil"
 )
 
 // Device homie device
 type Device interface {
+	// Name device ID, used in topics and as MQTT client ID
 	Name() string
+	// FriendlyName human readable name, published as $name, defaults to Name()
+	FriendlyName() string
+	SetFriendlyName(name string) Device
 	Stats() DeviceStats
-	NewNode(name string, nodeType string) Node
-	AddNode(node Node) Node
+	NewNode(name string, nodeType string) (Node, error)
+	// AddNode add a node, if device is connected node is subscribed and published and $nodes is republished
+	AddNode(node Node) (Node, error)
+	// RemoveNode remove a node, its /set topics are unsubscribed and its retained topics are cleared
+	RemoveNode(name string) error
 	GetNode(name string) Node
-	Run(block bool)
+	// NodeNames returns sorted slice of device nodes
+	NodeNames() []string
+	// Run connect to broker and block until ctx is done or device is stopped, on ctx done device is stopped gracefully
+	// returns ErrConnectFailed if initial connect failed after all attempts of config.Mqtt.Retry
+	Run(ctx context.Context) error
+	// Stop publish disconnected state, close periodic publishers, unsubscribe and disconnect from broker
+	Stop(ctx context.Context) error
+	// Wipe clear all retained topics of device, including stale topics found on broker, and disconnect without
+	// publishing $state, use it to decommission or rename a device
+	Wipe(ctx context.Context) error
 	Config() *Config
 	Client() MqttAdapter
-	OnConnect(client MqttAdapter)
+	OnConnect(client MqttAdapter) error
 
-	// Topic returns full topic for a part, prefixed with baseTopic and deviceName
+	// Topic returns full topic for a part, prefixed with baseTopic and deviceName (baseTopic/5/deviceName in Homie 5)
 	Topic(part string) string
 	SendMessage(topic string, value string)
+	// SendMessageWithOptions send a message with given QoS and retained flag, delivery errors are reported to
+	// publish error handler
+	SendMessageWithOptions(topic string, value string, qos byte, retained bool)
+	// SendMessageContext send a message and wait until it is delivered, ctx is done or config.Mqtt.PublishTimeout passed,
+	// returns ErrNotConnected if device is disconnected (message is queued if queue is enabled) or ErrPublishTimeout
+	SendMessageContext(ctx context.Context, topic string, value string, qos byte, retained bool) error
+	// Subscribe subscribe to a device topic, topic is relative to device topic, subscriptions are removed on Stop
+	Subscribe(topic string, qos byte, callback mqtt.MessageHandler)
+	// Unsubscribe remove a subscription, topic is relative to device topic
+	Unsubscribe(topic string)
+	// Retained default retained flag of property values, defaults to true
+	Retained() bool
+	SetRetained(retained bool) Device
+	// QoS default QoS of property values and /set subscriptions, defaults to 1
+	QoS() byte
+	// SetQoS set default QoS of properties, qos must be 0, 1 or 2
+	SetQoS(qos byte) Device
+
 	DevicePublisher() DevicePublisher
-	SetDevicePublisher(publisher DevicePublisher) Device
+	SetDevicePublisher(publisher DevicePublisher) error
+	// SetBrokerStatusHandler set a handler to be notified about active broker changes
+	SetBrokerStatusHandler(handler BrokerStatusHandler) Device
+	// SetOnConnectionLost set a handler to be called when connection to broker is lost
+	SetOnConnectionLost(handler ConnectionLostHandler) Device
+	// SetOnReconnect set a handler to be called after device is reconnected to a broker
+	SetOnReconnect(handler ReconnectHandler) Device
+	// SetOnPublishError set a handler to be called when a message is not delivered to broker
+	SetOnPublishError(handler PublishErrorHandler) Device
+	// SetOnWipe set a handler to be called by Wipe after device topics are cleared, before disconnect
+	SetOnWipe(handler WipeHandler) Device
 
 	PublishStats()
+
+	// Description returns Homie 5 description of device nodes and properties
+	Description() *Description
+	// State returns current device state, StateInit before the first connect
+	State() string
+	// SetState change device state and publish it as $state, StateLost is reserved for MQTT will
+	SetState(state string) error
+	// Sleep set device state to sleeping
+	Sleep() error
+	// Alert set device state to alert, in Homie 5 message is published to $alert/<id>
+	Alert(id string, message string) error
+	// ClearAlert set device state back to ready, in Homie 5 $alert/<id> is cleared
+	ClearAlert(id string) error
+
+	// Log publish a message to $log/<level> in Homie 5, in older versions message is logged locally
+	Log(level string, message string)
 }
 
 // DeviceStats stats about device like startup, connect time, etc
 type DeviceStats interface {
 	StartupTime() time.Time
 	ConnectTime() time.Time
+	// Broker returns URL of active broker, empty if device is not connected
+	Broker() string
+	// QueueDepth returns number of messages waiting for connection
+	QueueDepth() int
+	// QueueDropped returns number of messages dropped because queue was full
+	QueueDropped() uint64
+	// PublishFailed returns number of messages failed to be delivered to broker, timed out or dropped while disconnected
+	PublishFailed() uint64
+}
+
+// BrokerStatusHandler called when device connects to a broker or loses connection to it
+type BrokerStatusHandler func(broker string, connected bool)
+
+// ConnectionLostHandler called when connection to broker is lost, Run reconnects afterwards
+type ConnectionLostHandler func(d Device, err error)
+
+// ReconnectHandler called after device is reconnected and its topics are republished
+type ReconnectHandler func(d Device)
+
+// WipeHandler called by Wipe while device is still connected, to clear retained topics published for the device
+// outside of its subtree, an error fails Wipe
+type WipeHandler func(ctx context.Context, d Device) error
+
+// PublishErrorHandler called when a message is not delivered to broker, topic is full topic
+type PublishErrorHandler func(d Device, topic string, err error)
+
+type subscription struct {
+	topic    string
+	qos      byte
+	callback mqtt.MessageHandler
 }
 
 type device struct {
-	name      string
-	config    *Config
-	nodes     map[string]Node
-	stats     *deviceStats
-	publisher DevicePublisher
-	client    MqttAdapter
+	name         string
+	friendlyName string
+	config       *Config
+	nodes        map[string]Node
+	stats        *deviceStats
+	publisher    DevicePublisher
+	client       MqttAdapter
+	delegate     *mqttClientDelegate
+	state        string
+	queue        *publishQueue // nil if queue is disabled
+	retained     bool
+	qos          byte
+
+	initialised    bool // true after first OnConnect
+	sessionPresent bool // broker kept subscriptions of persistent session
+	subscriptions  []subscription
+	publishers     []PeriodicPublisher
+	stopped        chan struct{}
+
+	reconfigureMutex sync.Mutex // serialises structure changes and initialisation, they publish init state
+
+	// structure changes made while disconnected, applied on next connect
+	changedOffline      bool     // nodes or handlers changed, node topics are subscribed again
+	pendingClears       []string // retained topics of removed nodes and properties
+	pendingUnsubscribes []string // topics unsubscribed while broker keeps a persistent session
+
+	watches  []publishWatch // publishes waiting for delivery, in publish order
+	watching bool           // watchDeliveries is running
+
+	connectionLost        chan error
+	brokerHandler         BrokerStatusHandler
+	connectionLostHandler ConnectionLostHandler
+	reconnectHandler      ReconnectHandler
+	publishErrorHandler   PublishErrorHandler
+	wipeHandler           WipeHandler
 
 	mutex *sync.Mutex
 }
@@ -53,6 +175,11 @@ type device struct {
 type deviceStats struct {
 	startupTime time.Time
 	connectTime time.Time
+	broker      string
+	queue       *publishQueue
+
+	publishFailed uint64
+	mutex         sync.Mutex
 }
 
 func (s *deviceStats) StartupTime() time.Time {
@@ -60,30 +187,94 @@ func (s *deviceStats) StartupTime() time.Time {
 }
 
 func (s *deviceStats) ConnectTime() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return s.connectTime
 }
 
+func (s *deviceStats) Broker() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.broker
+}
+
+func (s *deviceStats) PublishFailed() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.publishFailed
+}
+
+func (s *deviceStats) QueueDepth() int {
+	return s.queue.depth()
+}
+
+func (s *deviceStats) QueueDropped() uint64 {
+	return s.queue.droppedCount()
+}
+
+// stopTimeout max wait to publish disconnected state when Run context is done
+const stopTimeout = 5 * time.Second
+
 // NewDevice create new homie device
-func NewDevice(name string, cfg *Config) Device {
+func NewDevice(name string, cfg *Config) (Device, error) {
+	if name == "" {
+		return nil, fmt.Errorf("%w: empty device name", ErrInvalidConfig)
+	}
+	if !IsValidID(name) {
+		return nil, fmt.Errorf("%w: device %q", ErrInvalidID, name)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	queue, err := newPublishQueue(cfg.Queue)
+	if err != nil {
+		return nil, err
+	}
 	return &device{
 		name:   name,
 		config: cfg,
+		queue:  queue,
 		stats: &deviceStats{
 			startupTime: time.Now(),
+			queue:       queue,
 		},
-		mutex: &sync.Mutex{},
-	}
+		state:          StateInit,
+		retained:       true,
+		qos:            defaultQoS,
+		delegate:       &mqttClientDelegate{},
+		stopped:        make(chan struct{}),
+		connectionLost: make(chan error, 1),
+		mutex:          &sync.Mutex{},
+	}, nil
 }
 
 func (d *device) Name() string {
 	return d.name
 }
 
+func (d *device) FriendlyName() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.friendlyName == "" {
+		return d.name
+	}
+	return d.friendlyName
+}
+
+func (d *device) SetFriendlyName(name string) Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.friendlyName = name
+	return d
+}
+
 func (d *device) Stats() DeviceStats {
 	return d.stats
 }
 
 func (d *device) Client() MqttAdapter {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	return d.client
 }
 
@@ -92,134 +283,731 @@ func (d *device) Config() *Config {
 }
 
 func (d *device) GetNode(name string) Node {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	return d.nodes[name]
 }
-func (d *device) NewNode(name string, nodeType string) Node {
-	return d.AddNode(&node{
-		name:     name,
-		nodeType: nodeType,
-	})
+
+func (d *device) NodeNames() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	names := make([]string, 0, len(d.nodes))
+	for name := range d.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-func (d *device) AddNode(node Node) Node {
-	node.SetDevice(d)
+func (d *device) NewNode(name string, nodeType string) (Node, error) {
+	return d.AddNode(NewNode(name, nodeType))
+}
+
+func (d *device) AddNode(node Node) (Node, error) {
+	if !IsValidID(node.Name()) {
+		return nil, fmt.Errorf("%w: node %q", ErrInvalidID, node.Name())
+	}
+	d.mutex.Lock()
 	if d.nodes == nil {
 		d.nodes = make(map[string]Node)
 	}
 	if _, alreadyAdded := d.nodes[node.Name()]; alreadyAdded {
-		log.Panic(fmt.Errorf("Node %s already added", node.Name()))
+		d.mutex.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrDuplicateNode, node.Name())
 	}
+	node.SetDevice(d)
 	d.nodes[node.Name()] = node
-	return node
+	d.mutex.Unlock()
+
+	d.reconfigure(func() {
+		node.Subscribe()
+		if !d.config.isVersion5() {
+			node.PublishAttributes()
+		}
+		node.Publish()
+	})
+	return node, nil
 }
 
-func (d *device) Run(block bool) {
-	options := d.createMqttOptions()
-	d.connect(options)
+func (d *device) RemoveNode(name string) error {
+	d.mutex.Lock()
+	node, ok := d.nodes[name]
+	delete(d.nodes, name)
+	d.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNodeNotFound, name)
+	}
 
-	if block {
-		select {} // block forever
+	for _, propName := range node.PropertyNames() {
+		d.Unsubscribe(node.NodeTopic(propName + "/set"))
 	}
+	clear := func() {
+		for _, propName := range node.PropertyNames() {
+			d.clearProperty(node, node.GetProperty(propName))
+		}
+		if !d.config.isVersion5() {
+			for _, attribute := range []string{"$name", "$type", "$properties"} {
+				d.clearTopic(node.NodeTopic(attribute))
+			}
+		}
+	}
+	if !d.reconfigure(clear) {
+		// topics are cleared on next connect
+		clear()
+	}
+	return nil
 }
 
-func (d *device) createMqttOptions() *mqtt.ClientOptions {
-	broker, err := url.Parse(fmt.Sprintf("tcp://%s:%d", d.config.Mqtt.Host, d.config.Mqtt.Port))
+// reconfigure apply a structure change (publish or clear topics) if device is connected,
+// device is in init state during the change and $nodes (or $description in Homie 5) is republished.
+// Returns false if device is not connected, node topics are subscribed again and structure is republished on next connect
+func (d *device) reconfigure(change func()) bool {
+	d.mutex.Lock()
+	online := d.initialised && d.client != nil && d.client.IsConnected()
+	if !online {
+		d.changedOffline = true
+	}
+	d.mutex.Unlock()
+	if !online {
+		return false
+	}
+	d.reconfigureMutex.Lock()
+	defer d.reconfigureMutex.Unlock()
+	state := d.State()
+	d.publishState(StateInit)
+	change()
+	if d.config.isVersion5() {
+		if description, err := d.Description().JSON(); err != nil {
+			log.Printf("Failed to create description of device %s: %v", d.name, err)
+		} else {
+			d.SendMessage("$description", string(description))
+		}
+	} else {
+		d.SendMessage("$nodes", strings.Join(d.NodeNames(), ","))
+	}
+	d.publishState(state)
+	return true
+}
+
+// clearProperty clear retained value and attributes of a removed property
+func (d *device) clearProperty(n Node, p Property) {
+	if p.Retained() {
+		d.clearTopic(n.NodeTopic(p.Name()))
+	}
+	attributes := []string{"$name", "$datatype", "$settable", "$retained", "$unit", "$format"}
+	if d.config.isVersion5() {
+		attributes = []string{"$target"}
+	}
+	for _, attribute := range attributes {
+		d.clearTopic(n.NodeTopic(p.Name() + "/" + attribute))
+	}
+}
+
+// clearTopic remove retained message of a topic, it is kept until next connect if device is not connected
+func (d *device) clearTopic(topic string) {
+	if !d.isConnected() {
+		d.mutex.Lock()
+		d.pendingClears = append(d.pendingClears, topic)
+		d.mutex.Unlock()
+		return
+	}
+	d.SendMessage(topic, "")
+}
+
+// flushClears clear retained topics of nodes and properties removed while device was not connected
+func (d *device) flushClears() {
+	d.mutex.Lock()
+	topics := d.pendingClears
+	d.pendingClears = nil
+	d.mutex.Unlock()
+	for _, topic := range topics {
+		d.SendMessage(topic, "")
+	}
+}
+
+func (d *device) Run(ctx context.Context) error {
+	options, err := d.createMqttOptions()
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+	brokers, err := d.config.Mqtt.brokerURLs()
+	if err != nil {
+		return err
+	}
+
+	// cancel connect attempts if device is stopped
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-d.stopped:
+			cancel()
+		case <-runCtx.Done():
+		}
+	}()
 
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s", broker.Host))
-	opts.SetUsername(d.config.Mqtt.Username)
-	opts.SetPassword(d.config.Mqtt.Password)
+	current, err := d.connect(runCtx, options, brokers, 0, d.config.Mqtt.Retry)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-d.stopped:
+			return nil
+		case <-ctx.Done():
+			return d.stopWithTimeout()
+		case err := <-d.connectionLost:
+			log.Printf("Device %s lost connection to %s: %v", d.name, brokers[current], err)
+			d.setBroker(brokers[current].String(), false)
+			d.mutex.Lock()
+			handler := d.connectionLostHandler
+			d.mutex.Unlock()
+			if handler != nil {
+				handler(d, err)
+			}
+			// failover to next broker
+			current, err = d.connect(runCtx, options, brokers, current+1, d.config.Mqtt.reconnectPolicy())
+			if err != nil {
+				return d.stopWithTimeout()
+			}
+		}
+	}
+}
+
+func (d *device) stopWithTimeout() error {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	return d.Stop(ctx)
+}
+
+func (d *device) createMqttOptions() (*mqtt.ClientOptions, error) {
+	opts, err := d.config.Mqtt.ClientOptions()
+	if err != nil {
+		return nil, err
+	}
 	opts.SetClientID(d.name)
+	opts.SetCleanSession(!d.config.Mqtt.PersistentSession)
 	opts.SetBinaryWill(d.Topic("$state"), []byte("lost"), 1, true)
-	opts.SetAutoReconnect(true)
-	opts.SetOnConnectHandler(func(c mqtt.Client) {
-		// TODO: refactor this, currently it creates multiple instances of delegates on re-connect
-		d.OnConnect(&mqttClientDelegate{
-			client: c,
-		})
+	// reconnect is done by Run to failover between brokers
+	opts.SetAutoReconnect(false)
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		select {
+		case d.connectionLost <- err:
+		default:
+		}
 	})
-	return opts
+	return opts, nil
 }
 
-func (d *device) OnConnect(client MqttAdapter) {
+// OnConnect initialise device after connect, on first connect properties are subscribed and publishers invoked,
+// on reconnect subscriptions are restored (unless broker kept the session), changes made while disconnected
+// are applied and all topics are republished
+func (d *device) OnConnect(client MqttAdapter) error {
+	d.mutex.Lock()
 	d.client = client
+	reconnect, sessionPresent, changed := d.initialised, d.sessionPresent, d.changedOffline
+	unsubscribes := d.pendingUnsubscribes
+	d.changedOffline, d.pendingUnsubscribes = false, nil
+	d.mutex.Unlock()
+	d.stats.mutex.Lock()
 	d.stats.connectTime = time.Now()
-	d.initNodes()
-	d.initDevice()
+	d.stats.mutex.Unlock()
+
+	if reconnect {
+		if !sessionPresent {
+			d.restoreSubscriptions()
+		} else {
+			d.unsubscribeRemoved(unsubscribes)
+		}
+		if changed {
+			// nodes added or handlers set while disconnected
+			d.initNodes()
+		}
+	} else {
+		// subscriptions made before first connect
+		d.restoreSubscriptions()
+		d.initNodes()
+		d.restoreStoredValues()
+		if err := d.loadRetained(); err != nil {
+			log.Printf("Failed to read retained topics of device %s: %v", d.name, err)
+		}
+	}
+	d.flushClears()
+	d.flushQueue()
+	if err := d.initDevice(); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	d.initialised = true
+	handler := d.reconnectHandler
+	d.mutex.Unlock()
+	if !reconnect {
+		d.invokePublishers()
+	} else if handler != nil {
+		handler(d)
+	}
+	return nil
+}
+
+// connect try brokers in order starting from start, each round of trying all brokers is an attempt of retry policy
+// returns index of connected broker
+func (d *device) connect(ctx context.Context, options *mqtt.ClientOptions, brokers []*url.URL, start int, retry RetryPolicy) (int, error) {
+	var connected int
+	err := mqttutil.Retry(ctx, "device "+d.name, retry.MaxAttempts, retry.Backoff, func() error {
+		var err error
+		for i := range brokers {
+			current := (start + i) % len(brokers)
+			options.Servers = []*url.URL{brokers[current]}
+			client := mqtt.NewClient(options)
+			d.addRoutes(client)
+			token := client.Connect()
+			if err = mqttutil.WaitToken(ctx, token); err == nil {
+				if connectToken, ok := token.(*mqtt.ConnectToken); ok {
+					d.mutex.Lock()
+					d.sessionPresent = connectToken.SessionPresent()
+					d.mutex.Unlock()
+				}
+				d.delegate.setClient(client)
+				if err := d.OnConnect(d.delegate); err != nil {
+					log.Printf("Failed to initialise device %s: %v", d.name, err)
+				}
+				d.setBroker(brokers[current].String(), true)
+				connected = current
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Failed to connect device %s to %s: %v", d.name, brokers[current], err)
+		}
+		return err
+	})
+	if err != nil && ctx.Err() == nil {
+		return 0, fmt.Errorf("%w: %v", ErrConnectFailed, err)
+	}
+	return connected, err
 }
 
-func (d *device) connect(options *mqtt.ClientOptions) mqtt.Client {
-	client := mqtt.NewClient(options)
-	token := client.Connect() // start connecting to broker, initialisation is done in onConnectHandler
-	for !token.WaitTimeout(3 * time.Second) {
+// setBroker update active broker in stats and call broker status handler
+func (d *device) setBroker(broker string, connected bool) {
+	d.stats.mutex.Lock()
+	if connected {
+		d.stats.broker = broker
+	} else {
+		d.stats.broker = ""
 	}
-	if err := token.Error(); err != nil {
-		log.Panic(err)
+	d.stats.mutex.Unlock()
+	d.mutex.Lock()
+	handler := d.brokerHandler
+	d.mutex.Unlock()
+	if handler != nil {
+		handler(broker, connected)
 	}
-	return client
+}
+
+func (d *device) SetBrokerStatusHandler(handler BrokerStatusHandler) Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.brokerHandler = handler
+	return d
+}
+
+func (d *device) SetOnConnectionLost(handler ConnectionLostHandler) Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.connectionLostHandler = handler
+	return d
+}
+
+func (d *device) SetOnWipe(handler WipeHandler) Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.wipeHandler = handler
+	return d
+}
+
+func (d *device) SetOnReconnect(handler ReconnectHandler) Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.reconnectHandler = handler
+	return d
+}
+
+func (d *device) SetOnPublishError(handler PublishErrorHandler) Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.publishErrorHandler = handler
+	return d
 }
 
 func (d *device) Topic(part string) string {
+	if d.config.isVersion5() {
+		return fmt.Sprintf("%s5/%s/%s", d.config.BaseTopic, d.Name(), part)
+	}
 	return fmt.Sprintf("%s%s/%s", d.config.BaseTopic, d.Name(), part)
 }
 
 func (d *device) SendMessage(topic string, message string) {
-	d.client.Publish(d.Topic(topic), 1, true, message)
+	d.SendMessageWithOptions(topic, message, 1, true)
+}
+
+func (d *device) SendMessageWithOptions(topic string, message string, qos byte, retained bool) {
+	token, err := d.publish(topic, message, qos, retained)
+	if err != nil {
+		// queued messages are published on connect
+		if d.queue == nil {
+			d.publishFailed(d.Topic(topic), err)
+		}
+		return
+	}
+	d.watchPublish(d.Topic(topic), token)
+}
+
+func (d *device) SendMessageContext(ctx context.Context, topic string, message string, qos byte, retained bool) error {
+	token, err := d.publish(topic, message, qos, retained)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, mqttutil.PublishTimeout(d.config.Mqtt.PublishTimeout))
+	defer cancel()
+	if err := mqttutil.WaitToken(ctx, token); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: %s", ErrPublishTimeout, d.Topic(topic))
+		}
+		d.publishFailed(d.Topic(topic), err)
+		return err
+	}
+	return nil
+}
+
+// publish send a message or queue it if device is disconnected and queue is enabled
+func (d *device) publish(topic string, message string, qos byte, retained bool) (mqtt.Token, error) {
+	client := d.Client()
+	if d.queue != nil && (client == nil || !client.IsConnected()) {
+		d.queue.push(queuedMessage{Topic: d.Topic(topic), Payload: message, QoS: qos, Retained: retained})
+		// connected meanwhile, queue may be already flushed
+		if d.isConnected() {
+			d.flushQueue()
+		}
+		return nil, fmt.Errorf("%w: device %s, message is queued", ErrNotConnected, d.name)
+	}
+	if client == nil {
+		return nil, fmt.Errorf("%w: device %s", ErrNotConnected, d.name)
+	}
+	return client.Publish(d.Topic(topic), qos, retained, message), nil
+}
+
+// maxWatches maximum number of publishes waiting for delivery, when it is reached failures of new publishes
+// are not reported
+const maxWatches = 1000
+
+type publishWatch struct {
+	topic    string
+	token    mqtt.Token
+	deadline time.Time
+}
+
+// watchPublish report failure of a message if it is not delivered until publish timeout,
+// deliveries are waited by a single goroutine which runs while there are pending publishes
+func (d *device) watchPublish(topic string, token mqtt.Token) {
+	w := publishWatch{topic: topic, token: token, deadline: time.Now().Add(mqttutil.PublishTimeout(d.config.Mqtt.PublishTimeout))}
+	d.mutex.Lock()
+	if len(d.watches) >= maxWatches {
+		d.mutex.Unlock()
+		return
+	}
+	d.watches = append(d.watches, w)
+	start := !d.watching
+	d.watching = true
+	d.mutex.Unlock()
+	if start {
+		go d.watchDeliveries()
+	}
+}
+
+// watchDeliveries wait for pending publishes in order until none is left
+func (d *device) watchDeliveries() {
+	for {
+		d.mutex.Lock()
+		if len(d.watches) == 0 {
+			d.watching = false
+			d.mutex.Unlock()
+			return
+		}
+		w := d.watches[0]
+		d.watches = d.watches[1:]
+		d.mutex.Unlock()
+
+		// a completed token is not reported as timed out if its deadline is passed while waiting for previous ones
+		wait := time.Until(w.deadline)
+		if wait < time.Millisecond {
+			wait = time.Millisecond
+		}
+		if !w.token.WaitTimeout(wait) {
+			d.publishFailed(w.topic, fmt.Errorf("%w: %s", ErrPublishTimeout, w.topic))
+		} else if err := w.token.Error(); err != nil {
+			d.publishFailed(w.topic, err)
+		}
+	}
+}
+
+// publishFailed count failed publish and call publish error handler
+func (d *device) publishFailed(topic string, err error) {
+	d.stats.mutex.Lock()
+	d.stats.publishFailed++
+	d.stats.mutex.Unlock()
+	d.mutex.Lock()
+	handler := d.publishErrorHandler
+	d.mutex.Unlock()
+	if handler != nil {
+		handler(d, topic, err)
+	} else {
+		log.Printf("Failed to publish to %s: %v", topic, err)
+	}
+}
+
+// flushQueue publish queued messages in order
+func (d *device) flushQueue() {
+	if d.queue == nil {
+		return
+	}
+	client := d.Client()
+	for _, m := range d.queue.drain() {
+		client.Publish(m.Topic, m.QoS, m.Retained, m.Payload)
+	}
+}
+
+func (d *device) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) {
+	s := subscription{topic: d.Topic(topic), qos: qos, callback: callback}
+	d.mutex.Lock()
+	client := d.client
+	replaced := false
+	for i := range d.subscriptions {
+		if d.subscriptions[i].topic == s.topic {
+			d.subscriptions[i] = s
+			replaced = true
+		}
+	}
+	if !replaced {
+		d.subscriptions = append(d.subscriptions, s)
+	}
+	d.mutex.Unlock()
+	if client != nil {
+		client.Subscribe(s.topic, s.qos, s.callback)
+	}
+}
+
+func (d *device) Unsubscribe(topic string) {
+	topic = d.Topic(topic)
+	d.mutex.Lock()
+	client := d.client
+	found := false
+	for i := range d.subscriptions {
+		if d.subscriptions[i].topic == topic {
+			d.subscriptions = append(d.subscriptions[:i], d.subscriptions[i+1:]...)
+			found = true
+			break
+		}
+	}
+	connected := client != nil && client.IsConnected()
+	if found && !connected && d.initialised && d.config.Mqtt.PersistentSession {
+		d.pendingUnsubscribes = append(d.pendingUnsubscribes, topic)
+	}
+	d.mutex.Unlock()
+	if found && connected {
+		client.Unsubscribe(topic)
+	}
+}
+
+// unsubscribeRemoved unsubscribe topics removed while disconnected from session kept by broker,
+// unless they are subscribed again
+func (d *device) unsubscribeRemoved(topics []string) {
+	d.mutex.Lock()
+	client := d.client
+	var removed []string
+	for _, topic := range topics {
+		subscribed := false
+		for _, s := range d.subscriptions {
+			subscribed = subscribed || s.topic == topic
+		}
+		if !subscribed {
+			removed = append(removed, topic)
+		}
+	}
+	d.mutex.Unlock()
+	if len(removed) > 0 {
+		client.Unsubscribe(removed...)
+	}
+}
+
+// addRoutes register callbacks of device subscriptions on a new client before it connects,
+// a broker which kept the persistent session delivers messages without subscribing again
+func (d *device) addRoutes(client mqtt.Client) {
+	d.mutex.Lock()
+	subscriptions := append([]subscription(nil), d.subscriptions...)
+	d.mutex.Unlock()
+	for _, s := range subscriptions {
+		if s.callback != nil {
+			client.AddRoute(s.topic, s.callback)
+		}
+	}
+}
+
+// restoreSubscriptions subscribe all device topics again after reconnect with a clean session
+func (d *device) restoreSubscriptions() {
+	d.mutex.Lock()
+	client := d.client
+	subscriptions := append([]subscription(nil), d.subscriptions...)
+	d.mutex.Unlock()
+	for _, s := range subscriptions {
+		client.Subscribe(s.topic, s.qos, s.callback)
+	}
+}
+
+func (d *device) Retained() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.retained
+}
+
+func (d *device) SetRetained(retained bool) Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.retained = retained
+	return d
+}
+
+func (d *device) QoS() byte {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.qos
+}
+
+func (d *device) SetQoS(qos byte) Device {
+	if !isValidQoS(qos) {
+		log.Printf("Invalid QoS %d of device: %s is ignored", qos, d.name)
+		return d
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.qos = qos
+	return d
 }
 
 func (d *device) DevicePublisher() DevicePublisher {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	return d.publisher
 }
 
-func (d *device) SetDevicePublisher(publisher DevicePublisher) Device {
+func (d *device) SetDevicePublisher(publisher DevicePublisher) error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	if d.publisher != nil {
-		panic(errors.New("DevicePublisher is already configured"))
+		return ErrPublisherConfigured
 	}
 	d.publisher = publisher
-	return d
+	return nil
 }
 
 func (d *device) PublishStats() {
+	if !d.config.hasExtension(ExtensionLegacyStats) {
+		return
+	}
 	diff := time.Since(d.Stats().StartupTime())
 	d.SendMessage("$stats/uptime", fmt.Sprintf("%d", uint64(diff.Seconds())))
 }
 
-func (d *device) initDevice() {
-	if !d.client.IsConnected() {
-		panic("not connected")
+func (d *device) Description() *Description {
+	return describeDevice(d)
+}
+
+func (d *device) Log(level string, message string) {
+	if !d.config.isVersion5() {
+		log.Printf("[%s] %s: %s", level, d.name, message)
+		return
 	}
-	d.SendMessage("$homie", HomieSpecVersion)
-	d.SendMessage("$name", d.name)
-	d.SendMessage("$localip", outboundIP())
-	d.SendMessage("$implementation", "homie-go")
-	d.SendMessage("$state", "ready")
-	d.SendMessage("$stats/interval", fmt.Sprintf("%d", d.config.StatsReportInterval))
+	d.SendMessageWithOptions(fmt.Sprintf("$log/%s", level), message, 0, false)
+}
 
-	var nodeNames []string
-	for _, n := range d.nodes {
-		nodeNames = append(nodeNames, n.Name())
+func (d *device) initDevice() error {
+	if !d.isConnected() {
+		return ErrNotConnected
+	}
+	// a concurrent structure change would restore init state
+	d.reconfigureMutex.Lock()
+	defer d.reconfigureMutex.Unlock()
+	state := d.connectedState()
+	if d.config.isVersion5() {
+		return d.initDeviceVersion5(state)
+	}
+	d.publishState(StateInit)
+	d.SendMessage("$homie", d.config.specVersion())
+	d.SendMessage("$name", d.FriendlyName())
+	if d.config.isVersion4() {
+		d.SendMessage("$extensions", strings.Join(d.config.Extensions, ","))
 	}
-	d.SendMessage("$nodes", strings.Join(nodeNames, ","))
-	for _, n := range d.nodes {
-		n.Publish()
+	if d.config.hasExtension(ExtensionLegacyFirmware) {
+		if ip, err := outboundIP(); err != nil {
+			log.Printf("Failed to find local IP of device %s: %v", d.name, err)
+		} else {
+			d.SendMessage("$localip", ip)
+		}
+		d.SendMessage("$implementation", "homie-go")
+	}
+	if d.config.hasExtension(ExtensionLegacyStats) {
+		d.SendMessage("$stats/interval", fmt.Sprintf("%d", d.config.StatsReportInterval))
 	}
 
-	if d.publisher != nil {
-		d.publisher(d)
+	d.SendMessage("$nodes", strings.Join(d.NodeNames(), ","))
+	for _, name := range d.NodeNames() {
+		d.GetNode(name).PublishAttributes().Publish()
 	}
 	d.PublishStats()
+	d.publishState(state)
+	return nil
+}
+
+func (d *device) initDeviceVersion5(state string) error {
+	d.publishState(StateInit)
+	description, err := d.Description().JSON()
+	if err != nil {
+		return err
+	}
+	d.SendMessage("$description", string(description))
+	for _, name := range d.NodeNames() {
+		d.GetNode(name).Publish()
+	}
+	d.publishState(state)
+	return nil
+}
+
+// connectedState returns state published after device is initialised, sleeping or alert state set while
+// device was not connected is kept, otherwise device is ready
+func (d *device) connectedState() string {
+	switch state := d.State(); state {
+	case StateSleeping, StateAlert:
+		return state
+	}
+	return StateReady
 }
 
 func (d *device) initNodes() {
-	for _, n := range d.nodes {
-		n.Subscribe()
-		if n.NodePublisher() != nil {
-			n.NodePublisher()(n) // invoke publishers
+	for _, name := range d.NodeNames() {
+		d.GetNode(name).Subscribe()
+	}
+}
+
+// invokePublishers invoke node and device publishers, it is done once on first connect
+func (d *device) invokePublishers() {
+	for _, name := range d.NodeNames() {
+		n := d.GetNode(name)
+		if publisher := n.NodePublisher(); publisher != nil {
+			publisher(n)
 		}
 	}
+	if publisher := d.DevicePublisher(); publisher != nil {
+		publisher(d)
+	}
 }
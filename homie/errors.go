@@ -0,0 +1,33 @@
+package homie
+
+import "errors"
+
+// Errors returned by homie, use errors.Is to check them as they are usually wrapped with more details
+var (
+	// ErrInvalidConfig device config or name is not valid
+	ErrInvalidConfig = errors.New("invalid config")
+	// ErrInvalidID device, node or property ID does not match Homie ID rules, see IsValidID
+	ErrInvalidID = errors.New("invalid ID")
+	// ErrDuplicateNode a node with the same name is already added to device
+	ErrDuplicateNode = errors.New("node already added")
+	// ErrNodeNotFound node is not added to device
+	ErrNodeNotFound = errors.New("node not found")
+	// ErrDuplicateProperty a property with the same name is already added to node
+	ErrDuplicateProperty = errors.New("property already added")
+	// ErrPropertyNotFound property is not added to node
+	ErrPropertyNotFound = errors.New("property not found")
+	// ErrPublisherConfigured device publisher is already configured
+	ErrPublisherConfigured = errors.New("device publisher already configured")
+	// ErrConnectFailed failed to connect to MQTT broker
+	ErrConnectFailed = errors.New("failed to connect to broker")
+	// ErrNotConnected device is not connected to MQTT broker
+	ErrNotConnected = errors.New("not connected")
+	// ErrPublishTimeout message is not delivered to broker within config.Mqtt.PublishTimeout
+	ErrPublishTimeout = errors.New("publish timed out")
+	// ErrInvalidState device state is not valid or not supported by Homie version
+	ErrInvalidState = errors.New("invalid device state")
+	// ErrInvalidDataType property datatype is not a Homie datatype
+	ErrInvalidDataType = errors.New("invalid datatype")
+	// ErrInvalidValue value does not match property datatype or format
+	ErrInvalidValue = errors.New("invalid value")
+)
@@ -1,12 +1,66 @@
+// Package homie implements Homie convention devices on top of paho MQTT client.
+//
+// Device, Node, Property and PeriodicPublisher are safe for concurrent use: SetValue, Publish,
+// AddNode, NewNode, AddProperty and setters can be called from any goroutine, including from
+// property handlers. Property handlers and connection handlers are called from MQTT client
+// goroutines, a slow handler delays delivery of next messages.
 package homie
 
 import (
+	"regexp"
+	"sync"
+
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 const (
-	// HomieSpecVersion Homie convention version
+	// HomieSpecVersion Homie convention version, used by default
 	HomieSpecVersion = "3.0.1"
+	// HomieSpecVersion4 Homie 4.0 convention version
+	HomieSpecVersion4 = "4.0.0"
+	// HomieSpecVersion5 Homie 5 convention version, device attributes are published as JSON $description
+	HomieSpecVersion5 = "5.0"
+)
+
+// idPattern Homie topic ID: lowercase letters, digits and hyphens, not starting with a hyphen
+var idPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// IsValidID check a device, node or property ID against Homie ID rules
+func IsValidID(id string) bool {
+	return idPattern.MatchString(id)
+}
+
+// defaultQoS QoS of property values and /set subscriptions if it is not configured
+const defaultQoS byte = 1
+
+// isValidQoS check qos is one of MQTT QoS levels
+func isValidQoS(qos byte) bool {
+	return qos <= 2
+}
+
+// Homie 4.0 extensions, legacy topics ($stats/*, $localip, $implementation) are published only if enabled
+const (
+	ExtensionLegacyStats    = "org.homie.legacy-stats:0.1.1:[4.x]"
+	ExtensionLegacyFirmware = "org.homie.legacy-firmware:0.1.1:[4.x]"
+)
+
+// Device states, published as $state, StateAlert is not supported in Homie 5
+const (
+	StateInit         = "init"
+	StateReady        = "ready"
+	StateDisconnected = "disconnected"
+	StateSleeping     = "sleeping"
+	StateLost         = "lost"
+	StateAlert        = "alert"
+)
+
+// Homie 5 log levels, see Device.Log
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+	LogLevelFatal = "fatal"
 )
 
 // PropertyHandler a handler function type for a propery
@@ -26,20 +80,52 @@ type MqttAdapter interface {
 	// Subscribe starts a new subscription. Provide a MessageHandler to be executed when
 	// a message is published on the topic provided, or nil for the default handler
 	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token
+
+	// Unsubscribe will end the subscription from each of the topics provided.
+	// Messages published to those topics from other clients will no longer be
+	// received.
+	Unsubscribe(topics ...string) mqtt.Token
+
+	// Disconnect will end the connection with the server, but not before waiting
+	// the specified number of milliseconds to wait for existing work to be
+	// completed.
+	Disconnect(quiesce uint)
 }
 
+// mqttClientDelegate delegates to current paho client, the client is replaced on reconnect
 type mqttClientDelegate struct {
 	client mqtt.Client
+	mutex  sync.RWMutex
+}
+
+func (a *mqttClientDelegate) setClient(client mqtt.Client) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.client = client
+}
+
+func (a *mqttClientDelegate) getClient() mqtt.Client {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.client
 }
 
 func (a *mqttClientDelegate) IsConnected() bool {
-	return a.client.IsConnected()
+	return a.getClient().IsConnected()
 }
 
 func (a *mqttClientDelegate) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
-	return a.client.Publish(topic, qos, retained, payload)
+	return a.getClient().Publish(topic, qos, retained, payload)
 }
 
 func (a *mqttClientDelegate) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
-	return a.client.Subscribe(topic, qos, callback)
+	return a.getClient().Subscribe(topic, qos, callback)
+}
+
+func (a *mqttClientDelegate) Unsubscribe(topics ...string) mqtt.Token {
+	return a.getClient().Unsubscribe(topics...)
+}
+
+func (a *mqttClientDelegate) Disconnect(quiesce uint) {
+	a.getClient().Disconnect(quiesce)
 }
@@ -1,10 +1,21 @@
 package homie
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/masgari/homie-go/internal/mqtttest"
+	"github.com/masgari/homie-go/internal/mqttutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -43,9 +54,91 @@ func (m *mqttAdapterMock) Subscribe(topic string, qos byte, callback mqtt.Messag
 	//args[2].(mqtt.MessageHandler)()
 	return args.Get(0).(mqtt.Token)
 }
+func (m *mqttAdapterMock) Unsubscribe(topics ...string) mqtt.Token {
+	args := m.Called(topics)
+	return args.Get(0).(mqtt.Token)
+}
+func (m *mqttAdapterMock) Disconnect(quiesce uint) {
+	m.Called(quiesce)
+}
+
+// doneToken a completed token without error
+type doneToken struct{}
+
+func (t *doneToken) Wait() bool                     { return true }
+func (t *doneToken) WaitTimeout(time.Duration) bool { return true }
+func (t *doneToken) Error() error                   { return nil }
+
+type publishedMessage struct {
+	qos      byte
+	retained bool
+	payload  string
+}
+
+// recordingAdapter records published messages by topic
+type recordingAdapter struct {
+	messages      map[string]publishedMessage
+	topics        []string
+	subscriptions []string
+	subscribedQoS map[string]byte
+	disconnected  bool
+}
+
+func newRecordingAdapter() *recordingAdapter {
+	return &recordingAdapter{messages: make(map[string]publishedMessage), subscribedQoS: make(map[string]byte)}
+}
+
+func (r *recordingAdapter) IsConnected() bool {
+	return !r.disconnected
+}
+func (r *recordingAdapter) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	r.messages[topic] = publishedMessage{qos: qos, retained: retained, payload: payload.(string)}
+	r.topics = append(r.topics, topic)
+	return &doneToken{}
+}
+func (r *recordingAdapter) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	r.subscriptions = append(r.subscriptions, topic)
+	r.subscribedQoS[topic] = qos
+	return &doneToken{}
+}
+func (r *recordingAdapter) Unsubscribe(topics ...string) mqtt.Token {
+	for _, topic := range topics {
+		for i, s := range r.subscriptions {
+			if s == topic {
+				r.subscriptions = append(r.subscriptions[:i], r.subscriptions[i+1:]...)
+				break
+			}
+		}
+	}
+	return &doneToken{}
+}
+func (r *recordingAdapter) Disconnect(quiesce uint) {
+	r.disconnected = true
+}
+
+func mustDevice(d Device, err error) Device {
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func mustNode(n Node, err error) Node {
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func mustProperty(p Property, err error) Property {
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
 
 func makeTestDevice(name string) Device {
-	return NewDevice(name, &Config{
+	return mustDevice(NewDevice(name, &Config{
 		Mqtt: MqttConfig{
 			Host:     "localhost",
 			Port:     1883,
@@ -54,21 +147,21 @@ func makeTestDevice(name string) Device {
 		},
 		BaseTopic:           "devices/",
 		StatsReportInterval: 60,
-	})
+	}))
 }
 func TestNewDevice(t *testing.T) {
 	d := makeTestDevice("test1")
 	assert.NotEqual(t, nil, d)
 	assert.NotEqual(t, nil, d.Config())
 
-	n1 := d.NewNode("n1", "Generic")
-	d.NewNode("n2", "Generic")
+	n1 := mustNode(d.NewNode("n1", "Generic"))
+	mustNode(d.NewNode("n2", "Generic"))
 	assert.NotEqual(t, nil, d.GetNode("n1"))
 	assert.NotEqual(t, nil, d.GetNode("n1").Device())
 	assert.NotEqual(t, nil, d.GetNode("n2"))
 	assert.NotEqual(t, nil, d.GetNode("n2").Device())
 
-	n1.NewProperty("p1", "integer")
+	mustProperty(n1.NewProperty("p1", "integer"))
 	assert.NotEqual(t, nil, n1.GetProperty("p1"))
 	assert.NotEqual(t, nil, n1.GetProperty("p1").Node())
 	assert.NotEqual(t, nil, n1.GetProperty("p1").Node().Device())
@@ -76,7 +169,7 @@ func TestNewDevice(t *testing.T) {
 
 func TestNodeTopic(t *testing.T) {
 	d := makeTestDevice("test2")
-	n := d.NewNode("n1", "Generic")
+	n := mustNode(d.NewNode("n1", "Generic"))
 	assert.Equal(t, "n1/$name", n.NodeTopic("$name"))
 }
 
@@ -85,7 +178,7 @@ func TestPropertyHandler(t *testing.T) {
 	n1 := node{
 		name: "n1",
 	}
-	d.AddNode(&n1)
+	mustNode(d.AddNode(&n1))
 
 	var (
 		receivedPayload []byte
@@ -103,18 +196,18 @@ func TestPropertyHandler(t *testing.T) {
 	p1 := &property{
 		name: "p1",
 	}
-	n1.AddProperty(p1).
+	mustProperty(n1.AddProperty(p1)).
 		SetHandler(handler)
 
 	token := new(mqttTokenMock)
 	client := new(mqttAdapterMock)
 	client.On("IsConnected").Return(true).Once()
 	// TODO: verify individual Publish calls by fixing m.Called() in mocked Publish() method and setup correct expectations
-	client.On("Publish").Return(token).Times(8 + 3 + 1) // 8 device messages (1 publish stats) + 3 node messages + 1 propery value
+	client.On("Publish").Return(&doneToken{}).Times(9 + 3 + 4 + 1) // 9 device messages (1 publish stats) + 3 node messages + 4 property attributes + 1 propery value
 	client.On("Subscribe", "devices/device-1/n1/p1/set", uint8(1), mock.AnythingOfType("mqtt.MessageHandler")).
 		Return(token).
 		Once()
-	d.OnConnect(client)
+	assert.NoError(t, d.OnConnect(client))
 
 	client.AssertExpectations(t)
 
@@ -128,37 +221,1035 @@ func TestPropertyHandler(t *testing.T) {
 
 func TestPeriodicPublisher(t *testing.T) {
 	d := makeTestDevice("test-periodic-publisher")
-	n := d.NewNode("n1", "Generic")
+	n := mustNode(d.NewNode("n1", "Generic"))
 
-	var c1, c2 int
+	var c1, c2 int32
 	p1 := NewPeriodicPublisher(time.Duration(8 * time.Millisecond))
 	p1.AddNodePublisher(n, func(n Node) {
-		t.Logf("c1: %d\n", c1)
-		c1++
+		atomic.AddInt32(&c1, 1)
 	})
 
 	token := new(mqttTokenMock)
 	client := new(mqttAdapterMock)
 	client.On("IsConnected").Return(true)
-	client.On("Publish").Return(token)
+	client.On("Publish").Return(&doneToken{})
 	client.On("Subscribe", mock.AnythingOfType("string"), uint8(1), mock.AnythingOfType("mqtt.MessageHandler")).
 		Return(token)
-	d.OnConnect(client)
+	assert.NoError(t, d.OnConnect(client))
 
 	time.Sleep(100 * time.Millisecond)
-	assert.True(t, c1 >= 9)
+	assert.True(t, atomic.LoadInt32(&c1) >= 9)
 
 	// change period
 	p2 := NewPeriodicPublisher(time.Duration(8 * time.Millisecond))
 	defer p2.Close()
 	p2.AddNodePublisher(n, func(n Node) {
-		t.Logf("c2: %d\n", c2)
-		c2++
+		atomic.AddInt32(&c2, 1)
 	})
 	p1.Close()
 
 	n.NodePublisher()(n) // can use p2.Start()
 
 	time.Sleep(100 * time.Millisecond)
-	assert.True(t, c2 >= 9)
+	assert.True(t, atomic.LoadInt32(&c2) >= 9)
+}
+
+func TestPropertyAttributes(t *testing.T) {
+	d := makeTestDevice("test-attributes")
+	n := mustNode(d.NewNode("n1", "Generic"))
+	p := mustProperty(n.NewProperty("temperature", ""))
+
+	assert.Equal(t, "temperature", p.FriendlyName())
+	assert.Equal(t, "string", p.Type())
+	assert.True(t, p.Retained())
+	assert.False(t, p.Settable())
+
+	p.SetFriendlyName("Temperature").
+		SetType("float").
+		SetUnit("°C").
+		SetFormat("-20:60").
+		SetRetained(false).
+		SetHandler(func(p Property, payload []byte, topic string) (bool, error) {
+			return true, nil
+		})
+
+	assert.Equal(t, "Temperature", p.FriendlyName())
+	assert.Equal(t, "float", p.Type())
+	assert.Equal(t, "°C", p.Unit())
+	assert.Equal(t, "-20:60", p.Format())
+	assert.False(t, p.Retained())
+	assert.True(t, p.Settable())
+}
+
+func TestValidateValue(t *testing.T) {
+	valid := []struct{ dataType, format, value string }{
+		{DataTypeInteger, "", "-12"},
+		{DataTypeInteger, "0:100", "100"},
+		{DataTypeInteger, ":10", "-5"},
+		{DataTypeFloat, "-20.5:60", "21.5"},
+		{DataTypeBoolean, "", "true"},
+		{DataTypeString, "", "anything"},
+		{DataTypeEnum, EnumFormat("low", "medium", "high"), "medium"},
+		{DataTypeColor, ColorFormatRGB, "255,0,12"},
+		{DataTypeColor, ColorFormatHSV, "360,100,0"},
+		{DataTypeDatetime, "", "2019-05-01T10:20:30Z"},
+		{DataTypeDuration, "", "PT12H5M46S"},
+	}
+	for _, v := range valid {
+		assert.NoError(t, ValidateValue(v.dataType, v.format, v.value), "%s %s %s", v.dataType, v.format, v.value)
+	}
+
+	invalid := []struct{ dataType, format, value string }{
+		{DataTypeInteger, "", "1.5"},
+		{DataTypeInteger, RangeFormat(0, 100), "101"},
+		{DataTypeFloat, "1.5:", "1.4"},
+		{DataTypeFloat, "", "abc"},
+		{DataTypeBoolean, "", "TRUE"},
+		{DataTypeEnum, "low,high", "medium"},
+		{DataTypeColor, ColorFormatRGB, "256,0,0"},
+		{DataTypeColor, ColorFormatRGB, "1,2"},
+		{DataTypeColor, "", "1,2,3"},
+		{DataTypeDatetime, "", "yesterday"},
+		{DataTypeDuration, "", "PT"},
+		{"time", "", "10:00"},
+	}
+	for _, v := range invalid {
+		assert.Error(t, ValidateValue(v.dataType, v.format, v.value), "%s %s %s", v.dataType, v.format, v.value)
+	}
+}
+
+func TestPropertyRejectsInvalidPayload(t *testing.T) {
+	d := makeTestDevice("test-invalid-payload")
+	n := mustNode(d.NewNode("n1", "Generic"))
+	called := false
+	p := mustProperty(n.NewProperty("level", DataTypeInteger)).
+		SetFormat(RangeFormat(0, 10)).
+		SetHandler(func(p Property, payload []byte, topic string) (bool, error) {
+			called = true
+			return true, nil
+		}).(*property)
+
+	p.onMessage("devices/test-invalid-payload/n1/level/set", []byte("11"))
+	assert.False(t, called)
+
+	p.onMessage("devices/test-invalid-payload/n1/level/set", []byte("10"))
+	assert.True(t, called)
+}
+
+func TestHomie4Device(t *testing.T) {
+	d := mustDevice(NewDevice("test-homie4", &Config{
+		BaseTopic:           "homie/",
+		StatsReportInterval: 60,
+		Version:             HomieSpecVersion4,
+		Extensions:          []string{ExtensionLegacyStats},
+	}))
+	n := mustNode(d.NewNode("n1", "Generic"))
+	mustProperty(n.NewProperty("p1", DataTypeInteger)).SetValue("1")
+	mustProperty(n.NewProperty("p2", DataTypeInteger)).SetValue("2").SetRetained(false)
+
+	client := newRecordingAdapter()
+	assert.NoError(t, d.OnConnect(client))
+
+	assert.Equal(t, "4.0.0", client.messages["homie/test-homie4/$homie"].payload)
+	assert.Equal(t, ExtensionLegacyStats, client.messages["homie/test-homie4/$extensions"].payload)
+	assert.Equal(t, "60", client.messages["homie/test-homie4/$stats/interval"].payload)
+	assert.Contains(t, client.messages, "homie/test-homie4/$stats/uptime")
+	assert.NotContains(t, client.messages, "homie/test-homie4/$localip")
+	assert.NotContains(t, client.messages, "homie/test-homie4/$implementation")
+
+	assert.Equal(t, "p1,p2", client.messages["homie/test-homie4/n1/$properties"].payload)
+	assert.True(t, client.messages["homie/test-homie4/n1/p1"].retained)
+	assert.False(t, client.messages["homie/test-homie4/n1/p2"].retained)
+	assert.Equal(t, "false", client.messages["homie/test-homie4/n1/p2/$retained"].payload)
+
+	assert.Equal(t, "homie/test-homie4/$state", client.topics[0])
+	assert.Equal(t, "homie/test-homie4/$state", client.topics[len(client.topics)-1])
+	assert.Equal(t, StateReady, client.messages["homie/test-homie4/$state"].payload)
+}
+
+func TestHomie5Device(t *testing.T) {
+	d := mustDevice(NewDevice("test-homie5", &Config{
+		BaseTopic: "homie/",
+		Version:   HomieSpecVersion5,
+	}))
+	n := mustNode(d.NewNode("n1", "Generic"))
+	mustProperty(n.NewProperty("p1", DataTypeInteger)).SetValue("1").SetUnit("%")
+	p2 := mustProperty(n.NewProperty("p2", DataTypeBoolean)).SetValue("false").
+		SetHandler(func(p Property, payload []byte, topic string) (bool, error) {
+			p.SetValue(string(payload))
+			return true, nil
+		})
+
+	client := newRecordingAdapter()
+	assert.NoError(t, d.OnConnect(client))
+
+	assert.NotContains(t, client.messages, "homie/5/test-homie5/$homie")
+	assert.NotContains(t, client.messages, "homie/5/test-homie5/$nodes")
+	assert.Equal(t, "1", client.messages["homie/5/test-homie5/n1/p1"].payload)
+	assert.Equal(t, StateReady, client.messages["homie/5/test-homie5/$state"].payload)
+
+	desc, err := ParseDescription([]byte(client.messages["homie/5/test-homie5/$description"].payload))
+	assert.NoError(t, err)
+	assert.Equal(t, HomieSpecVersion5, desc.Homie)
+	assert.NotZero(t, desc.Version)
+	assert.Equal(t, "%", desc.Nodes["n1"].Properties["p1"].Unit)
+	assert.False(t, desc.Nodes["n1"].Properties["p1"].Settable)
+	assert.True(t, desc.Nodes["n1"].Properties["p2"].Settable)
+	assert.Equal(t, DataTypeBoolean, desc.Nodes["n1"].Properties["p2"].Datatype)
+
+	p2.(*property).onMessage("homie/5/test-homie5/n1/p2/set", []byte("true"))
+	assert.Equal(t, "true", client.messages["homie/5/test-homie5/n1/p2/$target"].payload)
+	assert.Equal(t, "true", p2.Value())
+
+	d.Log(LogLevelWarn, "low battery")
+	assert.Equal(t, publishedMessage{qos: 0, retained: false, payload: "low battery"}, client.messages["homie/5/test-homie5/$log/warn"])
+}
+
+func TestDeviceLifecycle(t *testing.T) {
+	d := makeTestDevice("test-lifecycle")
+	assert.Equal(t, StateInit, d.State())
+	n := mustNode(d.NewNode("n1", "Generic"))
+	mustProperty(n.NewProperty("p1", DataTypeString)).
+		SetHandler(func(p Property, payload []byte, topic string) (bool, error) {
+			return true, nil
+		})
+	publisher := NewPeriodicPublisher(time.Hour)
+	publisher.AddNodePublisher(n, func(n Node) {})
+
+	client := newRecordingAdapter()
+	assert.NoError(t, d.OnConnect(client))
+	assert.Equal(t, StateReady, d.State())
+	assert.Equal(t, []string{"devices/test-lifecycle/n1/p1/set"}, client.subscriptions)
+
+	assert.NoError(t, d.Sleep())
+	assert.Equal(t, StateSleeping, client.messages["devices/test-lifecycle/$state"].payload)
+	assert.NoError(t, d.Alert("battery", "low battery"))
+	assert.Equal(t, StateAlert, d.State())
+	assert.NoError(t, d.ClearAlert("battery"))
+	assert.Equal(t, StateReady, d.State())
+	assert.Error(t, d.SetState(StateLost))
+	assert.Error(t, d.SetState("unknown"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, d.Stop(ctx))
+	assert.Equal(t, StateDisconnected, d.State())
+	assert.Equal(t, StateDisconnected, client.messages["devices/test-lifecycle/$state"].payload)
+	assert.Empty(t, client.subscriptions)
+	assert.True(t, client.disconnected)
+}
+
+func TestStateSetBeforeConnect(t *testing.T) {
+	d := makeTestDevice("test-sleeping")
+	assert.NoError(t, d.Sleep())
+
+	client := newRecordingAdapter()
+	assert.NoError(t, d.OnConnect(client))
+	assert.Equal(t, StateSleeping, d.State())
+	assert.Equal(t, StateSleeping, client.messages["devices/test-sleeping/$state"].payload)
+
+	assert.NoError(t, d.SetState(StateReady))
+	assert.NoError(t, d.OnConnect(client))
+	assert.Equal(t, StateReady, client.messages["devices/test-sleeping/$state"].payload)
+}
+
+func TestErrors(t *testing.T) {
+	_, err := NewDevice("", &Config{})
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+	_, err = NewDevice("test-errors", &Config{Version: "2.0"})
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+	_, err = NewDevice("test-errors", &Config{BaseTopic: "devices"})
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+
+	d := makeTestDevice("test-errors")
+	n := mustNode(d.NewNode("n1", "Generic"))
+	_, err = d.NewNode("n1", "Generic")
+	assert.True(t, errors.Is(err, ErrDuplicateNode))
+
+	mustProperty(n.NewProperty("p1", DataTypeString))
+	_, err = n.NewProperty("p1", DataTypeString)
+	assert.True(t, errors.Is(err, ErrDuplicateProperty))
+	_, err = n.NewProperty("p2", "time")
+	assert.True(t, errors.Is(err, ErrInvalidDataType))
+
+	_, err = NewDevicePublisher(d)
+	assert.NoError(t, err)
+	_, err = NewDevicePublisher(d)
+	assert.True(t, errors.Is(err, ErrPublisherConfigured))
+
+	assert.True(t, errors.Is(ValidateValue(DataTypeInteger, "", "x"), ErrInvalidValue))
+	assert.True(t, errors.Is(d.SetState("unknown"), ErrInvalidState))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	r := RetryPolicy{InitialInterval: 100 * time.Millisecond, MaxInterval: time.Second}
+	assert.Equal(t, 100*time.Millisecond, r.Backoff(1))
+	assert.Equal(t, 200*time.Millisecond, r.Backoff(2))
+	assert.Equal(t, 800*time.Millisecond, r.Backoff(4))
+	assert.Equal(t, time.Second, r.Backoff(10))
+
+	r.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		b := r.Backoff(1)
+		assert.True(t, b >= 50*time.Millisecond && b <= 150*time.Millisecond, "%s", b)
+	}
+}
+
+func TestRunConnectRetry(t *testing.T) {
+	d := mustDevice(NewDevice("test-run-retry", &Config{
+		Mqtt: MqttConfig{
+			Host: "127.0.0.1",
+			Port: 1, // nothing listens here
+			Retry: RetryPolicy{
+				MaxAttempts:     2,
+				InitialInterval: 10 * time.Millisecond,
+			},
+		},
+		BaseTopic: "devices/",
+	}))
+	err := d.Run(context.Background())
+	assert.True(t, errors.Is(err, ErrConnectFailed), "%v", err)
+
+	d = mustDevice(NewDevice("test-run-cancel", &Config{
+		Mqtt:      MqttConfig{Host: "127.0.0.1", Port: 1},
+		BaseTopic: "devices/",
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = d.Run(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+}
+
+func TestMqttOptions(t *testing.T) {
+	_, err := NewDevice("test-mqtt-options", &Config{Mqtt: MqttConfig{URL: "http://broker:80"}})
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+
+	d := mustDevice(NewDevice("test-mqtt-options", &Config{
+		Mqtt: MqttConfig{
+			URL: "wss://broker.example.com:443/mqtt",
+			TLS: TLSConfig{ServerName: "mqtt.example.com", InsecureSkipVerify: true},
+		},
+		BaseTopic: "devices/",
+	})).(*device)
+	opts, err := d.createMqttOptions()
+	assert.NoError(t, err)
+	brokers, err := d.config.Mqtt.brokerURLs()
+	assert.NoError(t, err)
+	assert.Equal(t, "wss://broker.example.com:443/mqtt", brokers[0].String())
+	assert.Equal(t, "mqtt.example.com", opts.TLSConfig.ServerName)
+	assert.True(t, opts.TLSConfig.InsecureSkipVerify)
+
+	d.config.Mqtt.TLS = TLSConfig{CAFile: "/nonexistent/ca.pem"}
+	_, err = d.createMqttOptions()
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+
+	d.config.Mqtt.URL = ""
+	d.config.Mqtt.Host = "localhost"
+	d.config.Mqtt.Port = 1883
+	brokers, err = d.config.Mqtt.brokerURLs()
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp://localhost:1883", brokers[0].String())
+
+	d.config.Mqtt.Brokers = []string{"ssl://primary:8883", "ssl://secondary:8883"}
+	brokers, err = d.config.Mqtt.brokerURLs()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(brokers))
+	assert.Equal(t, "ssl://secondary:8883", brokers[1].String())
+}
+
+func TestBrokerFailover(t *testing.T) {
+	primary, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer primary.Close()
+	secondary, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer secondary.Close()
+
+	d := mustDevice(NewDevice("test-failover", &Config{
+		Mqtt: MqttConfig{
+			Brokers: []string{"tcp://127.0.0.1:1", primary.URL(), secondary.URL()},
+			Retry:   RetryPolicy{InitialInterval: 10 * time.Millisecond},
+		},
+		BaseTopic: "devices/",
+	}))
+	type status struct {
+		broker    string
+		connected bool
+	}
+	statuses := make(chan status, 10)
+	d.SetBrokerStatusHandler(func(broker string, connected bool) {
+		statuses <- status{broker, connected}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+
+	assert.Equal(t, status{primary.URL(), true}, <-statuses) // unreachable first broker is skipped
+	assert.True(t, primary.WaitRetained("devices/test-failover/$state", StateReady, time.Second))
+
+	primary.Close()
+	assert.Equal(t, status{primary.URL(), false}, <-statuses)
+	assert.Equal(t, status{secondary.URL(), true}, <-statuses)
+
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Equal(t, "", d.Stats().Broker())
+	assert.True(t, secondary.WaitRetained("devices/test-failover/$state", StateDisconnected, time.Second))
+}
+
+func TestReconnect(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	d := mustDevice(NewDevice("test-reconnect", &Config{
+		Mqtt:      MqttConfig{URL: broker.URL()},
+		BaseTopic: "devices/",
+	}))
+	n := mustNode(d.NewNode("n1", "Generic"))
+	mustProperty(n.NewProperty("p1", DataTypeString)).
+		SetHandler(func(p Property, payload []byte, topic string) (bool, error) {
+			return true, nil
+		})
+	var publisherCalls int
+	n.SetNodePublisher(func(n Node) {
+		publisherCalls++
+	})
+	lost := make(chan error, 1)
+	reconnected := make(chan bool, 1)
+	d.SetOnConnectionLost(func(d Device, err error) {
+		lost <- err
+	})
+	d.SetOnReconnect(func(d Device) {
+		reconnected <- true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	assert.True(t, broker.WaitRetained("devices/test-reconnect/$state", StateReady, time.Second))
+	assert.Equal(t, 1, broker.SubscriptionCount())
+
+	broker.Publish("devices/test-reconnect/n1/$name", nil, true) // lost retained attribute
+	broker.DropClients()
+	assert.Error(t, <-lost)
+	<-reconnected
+
+	assert.True(t, broker.WaitRetained("devices/test-reconnect/n1/$name", "n1", time.Second))
+	assert.Equal(t, 1, broker.SubscriptionCount())
+	assert.Equal(t, 1, publisherCalls)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestReconnectPersistentSession(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	d := mustDevice(NewDevice("test-session", &Config{
+		Mqtt:      MqttConfig{URL: broker.URL(), PersistentSession: true},
+		BaseTopic: "devices/",
+	}))
+	received := make(chan string, 1)
+	n := mustNode(d.NewNode("n1", "Generic"))
+	mustProperty(n.NewProperty("p1", DataTypeString)).
+		SetHandler(func(p Property, payload []byte, topic string) (bool, error) {
+			received <- string(payload)
+			return true, nil
+		})
+	reconnected := make(chan bool, 1)
+	d.SetOnReconnect(func(d Device) {
+		reconnected <- true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	assert.True(t, broker.WaitRetained("devices/test-session/$state", StateReady, time.Second))
+
+	broker.DropClients()
+	<-reconnected
+	// broker kept subscriptions, messages are delivered to handlers of new client
+	assert.Equal(t, 1, broker.SubscriptionCount())
+	broker.Publish("devices/test-session/n1/p1/set", []byte("hello"), false)
+	select {
+	case payload := <-received:
+		assert.Equal(t, "hello", payload)
+	case <-time.After(time.Second):
+		t.Error("/set message is not delivered after reconnect with persistent session")
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestSubscribeBeforeRun(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	d := mustDevice(NewDevice("test-subscribe", &Config{
+		Mqtt:      MqttConfig{URL: broker.URL()},
+		BaseTopic: "devices/",
+	}))
+	received := make(chan string, 1)
+	d.Subscribe("$broadcast", 1, func(client mqtt.Client, message mqtt.Message) {
+		received <- string(message.Payload())
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	assert.True(t, broker.WaitRetained("devices/test-subscribe/$state", StateReady, time.Second))
+	assert.Equal(t, 1, broker.SubscriptionCount())
+
+	broker.Publish("devices/test-subscribe/$broadcast", []byte("hello"), false)
+	select {
+	case payload := <-received:
+		assert.Equal(t, "hello", payload)
+	case <-time.After(time.Second):
+		t.Error("topic subscribed before Run is not subscribed on connect")
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	d := mustDevice(NewDevice("test-concurrent", &Config{
+		Mqtt:      MqttConfig{URL: broker.URL()},
+		BaseTopic: "devices/",
+	}))
+	n := mustNode(d.NewNode("n1", "Generic"))
+	p := mustProperty(n.NewProperty("p1", DataTypeInteger)).
+		SetHandler(func(p Property, payload []byte, topic string) (bool, error) {
+			p.SetValue(string(payload)).Publish()
+			return true, nil
+		})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	assert.True(t, broker.WaitRetained("devices/test-concurrent/$state", StateReady, time.Second))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				value := fmt.Sprint(i*100 + j)
+				p.SetValue(value).Publish()
+				broker.Publish("devices/test-concurrent/n1/p1/set", []byte(value), false)
+				mustNode(d.NewNode(fmt.Sprintf("n%d-%d", i, j), "Generic")).PublishAttributes()
+				d.State()
+				d.Stats().Broker()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, StateReady, d.State())
+	assert.True(t, broker.WaitRetained("devices/test-concurrent/$state", StateReady, time.Second))
+	assert.Len(t, d.NodeNames(), 81)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestConcurrentNodes(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	d := mustDevice(NewDevice("test-concurrent-nodes", &Config{
+		Mqtt:      MqttConfig{URL: broker.URL()},
+		BaseTopic: "devices/",
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	assert.True(t, broker.WaitRetained("devices/test-concurrent-nodes/$state", StateReady, time.Second))
+
+	// structure changes from several goroutines restore ready state
+	for round := 0; round < 5; round++ {
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				mustNode(d.NewNode(fmt.Sprintf("n%d-%d", round, i), "Generic"))
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+		assert.Equal(t, StateReady, d.State(), "round %d", round)
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestDynamicNodes(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	d := mustDevice(NewDevice("test-dynamic", &Config{
+		Mqtt:      MqttConfig{URL: broker.URL()},
+		BaseTopic: "devices/",
+	}))
+	mustNode(d.NewNode("n1", "Generic"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	assert.True(t, broker.WaitRetained("devices/test-dynamic/$state", StateReady, time.Second))
+	assert.Equal(t, 0, broker.SubscriptionCount())
+
+	// add node and property after connect
+	n2 := mustNode(d.NewNode("n2", "Sensor"))
+	mustProperty(n2.NewProperty("p1", DataTypeInteger)).
+		SetHandler(func(p Property, payload []byte, topic string) (bool, error) {
+			return true, nil
+		}).
+		SetValue("1").
+		Publish()
+	assert.True(t, broker.WaitRetained("devices/test-dynamic/$nodes", "n1,n2", time.Second))
+	assert.True(t, broker.WaitRetained("devices/test-dynamic/n2/$properties", "p1", time.Second))
+	assert.True(t, broker.WaitRetained("devices/test-dynamic/n2/p1", "1", time.Second))
+	assert.True(t, broker.WaitRetained("devices/test-dynamic/n2/p1/$settable", "true", time.Second))
+	assert.Equal(t, 1, broker.SubscriptionCount())
+	assert.True(t, broker.WaitRetained("devices/test-dynamic/$state", StateReady, time.Second))
+
+	mustProperty(n2.NewProperty("p2", DataTypeString))
+	assert.True(t, broker.WaitRetained("devices/test-dynamic/n2/$properties", "p1,p2", time.Second))
+
+	// remove property and node
+	assert.NoError(t, n2.RemoveProperty("p1"))
+	assert.True(t, broker.WaitRetained("devices/test-dynamic/n2/$properties", "p2", time.Second))
+	assert.True(t, broker.WaitRetained("devices/test-dynamic/n2/p1/$datatype", "", time.Second))
+	assert.Empty(t, broker.RetainedTopics("devices/test-dynamic/n2/p1/#"))
+	assert.Equal(t, 0, broker.SubscriptionCount())
+	assert.True(t, errors.Is(n2.RemoveProperty("p1"), ErrPropertyNotFound))
+
+	assert.NoError(t, d.RemoveNode("n2"))
+	assert.True(t, broker.WaitRetained("devices/test-dynamic/$nodes", "n1", time.Second))
+	assert.True(t, broker.WaitRetained("devices/test-dynamic/n2/$name", "", time.Second))
+	assert.Empty(t, broker.RetainedTopics("devices/test-dynamic/n2/#"))
+	assert.True(t, errors.Is(d.RemoveNode("n2"), ErrNodeNotFound))
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestDynamicNodesOffline(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	d := mustDevice(NewDevice("test-offline", &Config{
+		Mqtt:      MqttConfig{URL: broker.URL()},
+		BaseTopic: "devices/",
+	}))
+	n1 := mustNode(d.NewNode("n1", "Generic"))
+	mustProperty(n1.NewProperty("p1", DataTypeString)).SetValue("v1")
+	n2 := mustNode(d.NewNode("n2", "Generic"))
+	mustProperty(n2.NewProperty("p2", DataTypeString)).SetValue("v2")
+
+	// change nodes while device is disconnected
+	received := make(chan string, 1)
+	d.SetOnConnectionLost(func(d Device, err error) {
+		n3 := mustNode(d.NewNode("n3", "Generic"))
+		mustProperty(n3.NewProperty("p3", DataTypeString)).
+			SetHandler(func(p Property, payload []byte, topic string) (bool, error) {
+				received <- string(payload)
+				return true, nil
+			})
+		assert.NoError(t, d.RemoveNode("n2"))
+		assert.NoError(t, n1.RemoveProperty("p1"))
+	})
+	reconnected := make(chan bool, 1)
+	d.SetOnReconnect(func(d Device) {
+		reconnected <- true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	assert.True(t, broker.WaitRetained("devices/test-offline/$state", StateReady, time.Second))
+	assert.True(t, broker.WaitRetained("devices/test-offline/n2/p2", "v2", time.Second))
+
+	broker.DropClients()
+	<-reconnected
+	assert.True(t, broker.WaitRetained("devices/test-offline/$nodes", "n1,n3", time.Second))
+	assert.True(t, broker.WaitRetained("devices/test-offline/n3/p3/$settable", "true", time.Second))
+	assert.True(t, broker.WaitRetained("devices/test-offline/n1/$properties", "", time.Second))
+	assert.Empty(t, broker.RetainedTopics("devices/test-offline/n1/p1/#"))
+	assert.Empty(t, broker.RetainedTopics("devices/test-offline/n2/#"))
+
+	broker.Publish("devices/test-offline/n3/p3/set", []byte("hello"), false)
+	select {
+	case payload := <-received:
+		assert.Equal(t, "hello", payload)
+	case <-time.After(time.Second):
+		t.Error("/set topic of node added while disconnected is not subscribed")
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestWipe(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	d := mustDevice(NewDevice("test-wipe", &Config{
+		Mqtt:      MqttConfig{URL: broker.URL()},
+		BaseTopic: "devices/",
+	}))
+	n := mustNode(d.NewNode("n1", "Generic"))
+	mustProperty(n.NewProperty("p1", DataTypeString)).SetValue("v1")
+	assert.Error(t, d.Wipe(context.Background()))
+	broker.Publish("devices/test-wipe/old/p1/$name", []byte("stale"), true)
+
+	done := make(chan error)
+	go func() { done <- d.Run(context.Background()) }()
+	assert.True(t, broker.WaitRetained("devices/test-wipe/$state", StateReady, time.Second))
+	assert.NotEmpty(t, broker.RetainedTopics("devices/test-wipe/n1/#"))
+
+	assert.NoError(t, d.Wipe(context.Background()))
+	assert.NoError(t, <-done)
+	assert.Empty(t, broker.RetainedTopics("devices/test-wipe/#"))
+
+	// wipe from description without a live device
+	broker.Publish("devices/5/test-wipe5/$state", []byte(StateReady), true)
+	broker.Publish("devices/5/test-wipe5/n1/p1", []byte("1"), true)
+	opts := mqtt.NewClientOptions().AddBroker(broker.URL())
+	client := mqtt.NewClient(opts)
+	assert.NoError(t, mqttutil.WaitToken(context.Background(), client.Connect()))
+	defer client.Disconnect(0)
+	desc := &Description{Homie: HomieSpecVersion5}
+	assert.NoError(t, WipeDevice(context.Background(), client, "devices/", "test-wipe5", desc))
+	assert.Empty(t, broker.RetainedTopics("devices/5/test-wipe5/#"))
+}
+
+func TestCleanupStaleTopics(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	// topics of previous version of device
+	broker.Publish("devices/test-cleanup/$nodes", []byte("n1,temp2"), true)
+	broker.Publish("devices/test-cleanup/temp2/$name", []byte("temp2"), true)
+	broker.Publish("devices/test-cleanup/temp2/t/$datatype", []byte("float"), true)
+	broker.Publish("devices/test-cleanup/n1/p1/$unit", []byte("°C"), true)
+	broker.Publish("devices/test-cleanup/n1/p1", []byte("21"), true)
+
+	d := mustDevice(NewDevice("test-cleanup", &Config{
+		Mqtt:               MqttConfig{URL: broker.URL()},
+		BaseTopic:          "devices/",
+		CleanupStaleTopics: true,
+	}))
+	n := mustNode(d.NewNode("n1", "Generic"))
+	mustProperty(n.NewProperty("p1", DataTypeFloat)).SetValue("22")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	assert.True(t, broker.WaitRetained("devices/test-cleanup/$state", StateReady, 2*time.Second))
+
+	assert.Empty(t, broker.RetainedTopics("devices/test-cleanup/temp2/#"))
+	_, unit := broker.Retained("devices/test-cleanup/n1/p1/$unit")
+	assert.False(t, unit)
+	assert.True(t, broker.WaitRetained("devices/test-cleanup/$nodes", "n1", time.Second))
+	assert.True(t, broker.WaitRetained("devices/test-cleanup/n1/p1", "22", time.Second))
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestRestoreValues(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	broker.Publish("devices/test-restore/n1/relay", []byte("true"), true)
+	broker.Publish("devices/test-restore/n1/level", []byte("7"), true)
+	broker.Publish("devices/test-restore/n1/mode", []byte("invalid"), true)
+
+	d := mustDevice(NewDevice("test-restore", &Config{
+		Mqtt:                 MqttConfig{URL: broker.URL()},
+		BaseTopic:            "devices/",
+		RestoreValues:        true,
+		RestoreCallsHandlers: true,
+	}))
+	n := mustNode(d.NewNode("n1", "Generic"))
+	applied := make(chan string, 1)
+	relay := mustProperty(n.NewProperty("relay", DataTypeBoolean)).
+		SetHandler(func(p Property, payload []byte, topic string) (bool, error) {
+			applied <- string(payload)
+			return true, nil
+		})
+	level := mustProperty(n.NewProperty("level", DataTypeInteger)).SetValue("3")
+	mode := mustProperty(n.NewProperty("mode", DataTypeEnum)).SetFormat(EnumFormat("auto", "manual"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	assert.True(t, broker.WaitRetained("devices/test-restore/$state", StateReady, 2*time.Second))
+
+	assert.Equal(t, "true", <-applied)
+	assert.Equal(t, "true", relay.Value())
+	assert.Equal(t, "3", level.Value())
+	assert.Equal(t, "", mode.Value())
+	assert.True(t, broker.WaitRetained("devices/test-restore/n1/relay", "true", time.Second))
+	assert.True(t, broker.WaitRetained("devices/test-restore/n1/level", "3", time.Second))
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "homie-store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	stores := map[string]func(path string) (StateStore, error){
+		"file": NewFileStore,
+		"bolt": NewBoltStore,
+	}
+	for name, newStore := range stores {
+		path := filepath.Join(dir, name)
+		newDevice := func() (Device, Property, Property) {
+			store, err := newStore(path)
+			assert.NoError(t, err)
+			cfg := &Config{BaseTopic: "devices/", Store: store}
+			d := mustDevice(NewDevice("test-store", cfg))
+			n := mustNode(d.NewNode("n1", "Generic"))
+			mode := mustProperty(n.NewProperty("mode", DataTypeString)).SetPersistent(true)
+			temp := mustProperty(n.NewProperty("temp", DataTypeFloat))
+			return d, mode, temp
+		}
+
+		d, mode, temp := newDevice()
+		assert.Equal(t, "", mode.Value(), name)
+		mode.SetValue("auto")
+		temp.SetValue("21.5")
+		assert.NoError(t, d.Config().Store.Close())
+
+		d, mode, temp = newDevice()
+		assert.Equal(t, "auto", mode.Value(), name)
+		assert.Equal(t, "", temp.Value(), name)
+		_, ok, err := d.Config().Store.Load("test-store/n1/temp")
+		assert.NoError(t, err)
+		assert.False(t, ok, name)
+
+		// store is shared by devices
+		other := mustDevice(NewDevice("test-store-2", &Config{BaseTopic: "devices/", Store: d.Config().Store}))
+		n := mustNode(other.NewNode("n1", "Generic"))
+		assert.Equal(t, "", mustProperty(n.NewProperty("mode", DataTypeString)).SetPersistent(true).Value(), name)
+		value, ok, err := d.Config().Store.Load("test-store/n1/mode")
+		assert.NoError(t, err)
+		assert.True(t, ok, name)
+		assert.Equal(t, "auto", value, name)
+		assert.NoError(t, d.Config().Store.Close())
+	}
+}
+
+func TestPublishQueue(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+	dir, err := ioutil.TempDir("", "homie-queue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{
+		Mqtt:      MqttConfig{URL: broker.URL()},
+		BaseTopic: "devices/",
+		Queue:     QueueConfig{Size: 3, Path: filepath.Join(dir, "queue.json")},
+	}
+	d := mustDevice(NewDevice("test-queue", cfg))
+	d.SendMessage("t1", "v1")
+	d.SendMessage("t2", "v1")
+	d.SendMessage("t1", "v2") // replaces queued t1
+	d.SendMessage("t3", "v1")
+	d.SendMessage("t4", "v1") // drops t2
+	assert.Equal(t, 3, d.Stats().QueueDepth())
+	assert.Equal(t, uint64(1), d.Stats().QueueDropped())
+
+	// queue is loaded from file
+	d = mustDevice(NewDevice("test-queue", cfg))
+	assert.Equal(t, 3, d.Stats().QueueDepth())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	assert.True(t, broker.WaitRetained("devices/test-queue/$state", StateReady, time.Second))
+	assert.True(t, broker.WaitRetained("devices/test-queue/t1", "v2", time.Second))
+	assert.True(t, broker.WaitRetained("devices/test-queue/t3", "v1", time.Second))
+	assert.True(t, broker.WaitRetained("devices/test-queue/t4", "v1", time.Second))
+	_, ok := broker.Retained("devices/test-queue/t2")
+	assert.False(t, ok)
+	assert.Equal(t, 0, d.Stats().QueueDepth())
+
+	cancel()
+	assert.NoError(t, <-done)
+
+	_, err = NewDevice("test-queue", &Config{Queue: QueueConfig{Size: 1, DropPolicy: "random"}})
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+}
+
+// resultToken a token completed with an error, or never completed if pending is true
+type resultToken struct {
+	err     error
+	pending bool
+}
+
+func (t *resultToken) Wait() bool {
+	if t.pending {
+		select {}
+	}
+	return true
+}
+func (t *resultToken) WaitTimeout(time.Duration) bool { return !t.pending }
+func (t *resultToken) Error() error                   { return t.err }
+
+// slowToken a token which is never completed, WaitTimeout waits for the whole timeout
+type slowToken struct{}
+
+func (t *slowToken) Wait() bool { select {} }
+func (t *slowToken) WaitTimeout(timeout time.Duration) bool {
+	time.Sleep(timeout)
+	return false
+}
+func (t *slowToken) Error() error { return nil }
+
+// tokenAdapter connected adapter returning token on publish
+type tokenAdapter struct {
+	recordingAdapter
+	token mqtt.Token
+}
+
+func (a *tokenAdapter) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return a.token
+}
+
+func TestPublishErrors(t *testing.T) {
+	d := mustDevice(NewDevice("test-publish-errors", &Config{
+		BaseTopic: "devices/",
+		Mqtt:      MqttConfig{PublishTimeout: 20 * time.Millisecond},
+	}))
+	n := mustNode(d.NewNode("n1", "Generic"))
+	p := mustProperty(n.NewProperty("p1", DataTypeString))
+	assert.True(t, errors.Is(p.PublishContext(context.Background()), ErrNotConnected))
+	assert.Equal(t, uint64(0), d.Stats().PublishFailed())
+
+	failed := make(chan string, 1)
+	d.SetOnPublishError(func(d Device, topic string, err error) {
+		failed <- topic
+	})
+	// dropped while disconnected
+	p.Publish()
+	assert.Equal(t, "devices/test-publish-errors/n1/p1", <-failed)
+	assert.Equal(t, uint64(1), d.Stats().PublishFailed())
+
+	adapter := &tokenAdapter{recordingAdapter: *newRecordingAdapter()}
+	d.(*device).client = adapter
+
+	adapter.token = &resultToken{err: errors.New("broken pipe")}
+	assert.EqualError(t, p.PublishContext(context.Background()), "broken pipe")
+	assert.Equal(t, "devices/test-publish-errors/n1/p1", <-failed)
+
+	adapter.token = &resultToken{pending: true}
+	assert.True(t, errors.Is(n.PublishContext(context.Background()), ErrPublishTimeout))
+	<-failed
+
+	adapter.token = &resultToken{err: errors.New("broken pipe")}
+	d.SendMessage("$name", "n")
+	assert.Equal(t, "devices/test-publish-errors/$name", <-failed)
+	assert.Equal(t, uint64(4), d.Stats().PublishFailed())
+
+	adapter.token = &doneToken{}
+	assert.NoError(t, d.SendMessageContext(context.Background(), "$name", "n", 1, true))
+	assert.Equal(t, uint64(4), d.Stats().PublishFailed())
+
+	// undelivered messages are watched by one goroutine
+	d.SetOnPublishError(func(d Device, topic string, err error) {})
+	adapter.token = &slowToken{}
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		d.SendMessage("$name", "n")
+	}
+	assert.True(t, runtime.NumGoroutine() <= goroutines+1)
+	deadline := time.Now().Add(time.Second)
+	for d.Stats().PublishFailed() < 54 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(54), d.Stats().PublishFailed())
+}
+
+func TestQoSAndRetained(t *testing.T) {
+	d := makeTestDevice("test-qos").SetQoS(0)
+	telemetry := mustNode(d.NewNode("telemetry", "Sensor")).SetRetained(false)
+	commands := mustNode(d.NewNode("commands", "Switch")).SetQoS(2)
+	temperature := mustProperty(telemetry.NewProperty("temperature", DataTypeFloat)).SetValue("21.5")
+	relay := mustProperty(commands.NewProperty("relay", DataTypeBoolean)).
+		SetValue("true").
+		SetHandler(func(p Property, payload []byte, topic string) (bool, error) {
+			return true, nil
+		})
+	mustProperty(telemetry.NewProperty("state", DataTypeString)).SetRetained(true).SetQoS(1).SetValue("ok")
+	d.SetQoS(3) // ignored
+
+	assert.Equal(t, byte(0), temperature.QoS())
+	assert.False(t, temperature.Retained())
+	assert.Equal(t, byte(2), relay.QoS())
+	assert.True(t, relay.Retained())
+
+	client := newRecordingAdapter()
+	assert.NoError(t, d.OnConnect(client))
+	assert.Equal(t, publishedMessage{qos: 0, retained: false, payload: "21.5"}, client.messages["devices/test-qos/telemetry/temperature"])
+	assert.Equal(t, "false", client.messages["devices/test-qos/telemetry/temperature/$retained"].payload)
+	assert.Equal(t, publishedMessage{qos: 2, retained: true, payload: "true"}, client.messages["devices/test-qos/commands/relay"])
+	assert.Equal(t, byte(2), client.subscribedQoS["devices/test-qos/commands/relay/set"])
+	assert.Equal(t, publishedMessage{qos: 1, retained: true, payload: "ok"}, client.messages["devices/test-qos/telemetry/state"])
+	assert.Equal(t, "true", client.messages["devices/test-qos/telemetry/state/$retained"].payload)
+}
+
+func TestIDsAndFriendlyNames(t *testing.T) {
+	for _, id := range []string{"device", "sensor-2", "0", "a-b-c"} {
+		assert.True(t, IsValidID(id), id)
+	}
+	for _, id := range []string{"", "-sensor", "Sensor", "living room", "temp_2", "$state", "température"} {
+		assert.False(t, IsValidID(id), id)
+	}
+
+	_, err := NewDevice("Living Room", &Config{})
+	assert.True(t, errors.Is(err, ErrInvalidID))
+	d := makeTestDevice("living-room").SetFriendlyName("Living Room")
+	_, err = d.NewNode("Lamp", "Light")
+	assert.True(t, errors.Is(err, ErrInvalidID))
+	n := mustNode(d.NewNode("lamp", "Light")).SetFriendlyName("Stehlampe 💡")
+	_, err = n.NewProperty("on_off", DataTypeBoolean)
+	assert.True(t, errors.Is(err, ErrInvalidID))
+	mustProperty(n.NewProperty("power", DataTypeBoolean)).SetFriendlyName("Power")
+
+	client := newRecordingAdapter()
+	assert.NoError(t, d.OnConnect(client))
+	assert.Equal(t, "Living Room", client.messages["devices/living-room/$name"].payload)
+	assert.Equal(t, "Stehlampe 💡", client.messages["devices/living-room/lamp/$name"].payload)
+	assert.Equal(t, "Power", client.messages["devices/living-room/lamp/power/$name"].payload)
+	assert.Equal(t, "Living Room", d.Description().Name)
+	assert.Equal(t, "Stehlampe 💡", d.Description().Nodes["lamp"].Name)
 }
@@ -0,0 +1,176 @@
+package homie
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/masgari/homie-go/internal/mqttutil"
+)
+
+// reconfigurer implemented by devices to republish their structure when nodes or properties are changed at runtime
+type reconfigurer interface {
+	reconfigure(change func()) bool
+	clearProperty(n Node, p Property)
+}
+
+// publisherRegistry implemented by devices to close periodic publishers on Stop
+type publisherRegistry interface {
+	registerPublisher(p PeriodicPublisher)
+}
+
+func (d *device) registerPublisher(p PeriodicPublisher) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, registered := range d.publishers {
+		if registered == p {
+			return
+		}
+	}
+	d.publishers = append(d.publishers, p)
+}
+
+func (d *device) State() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.state
+}
+
+func (d *device) SetState(state string) error {
+	switch state {
+	case StateInit, StateReady, StateDisconnected, StateSleeping:
+	case StateAlert:
+		if d.config.isVersion5() {
+			return fmt.Errorf("%w: %s is not supported in Homie %s, use Alert", ErrInvalidState, state, HomieSpecVersion5)
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidState, state)
+	}
+	if !d.isConnected() {
+		d.mutex.Lock()
+		d.state = state // not connected, sleeping and alert states are published on connect
+		d.mutex.Unlock()
+		return nil
+	}
+	d.publishState(state)
+	return nil
+}
+
+func (d *device) Sleep() error {
+	return d.SetState(StateSleeping)
+}
+
+func (d *device) Alert(id string, message string) error {
+	if d.config.isVersion5() {
+		if !d.isConnected() {
+			return fmt.Errorf("%w: device %s", ErrNotConnected, d.name)
+		}
+		d.SendMessage(fmt.Sprintf("$alert/%s", id), message)
+		return nil
+	}
+	log.Printf("Device %s alert %s: %s", d.name, id, message)
+	return d.SetState(StateAlert)
+}
+
+func (d *device) ClearAlert(id string) error {
+	if d.config.isVersion5() {
+		if !d.isConnected() {
+			return fmt.Errorf("%w: device %s", ErrNotConnected, d.name)
+		}
+		d.SendMessage(fmt.Sprintf("$alert/%s", id), "")
+		return nil
+	}
+	if d.State() != StateAlert {
+		return nil
+	}
+	return d.SetState(StateReady)
+}
+
+func (d *device) isConnected() bool {
+	client := d.Client()
+	return client != nil && client.IsConnected()
+}
+
+// publishState keep state and publish it as $state
+func (d *device) publishState(state string) {
+	d.mutex.Lock()
+	d.state = state
+	d.mutex.Unlock()
+	d.SendMessage("$state", state)
+}
+
+func (d *device) Stop(ctx context.Context) error {
+	return d.stop(ctx, false)
+}
+
+func (d *device) Wipe(ctx context.Context) error {
+	if !d.isConnected() {
+		return fmt.Errorf("%w: device %s", ErrNotConnected, d.name)
+	}
+	return d.stop(ctx, true)
+}
+
+// stop close publishers, unsubscribe and disconnect, $state is published as disconnected or all topics are wiped
+func (d *device) stop(ctx context.Context, wipe bool) error {
+	d.mutex.Lock()
+	publishers := d.publishers
+	d.publishers = nil
+	d.mutex.Unlock()
+	for _, p := range publishers {
+		p.Close()
+	}
+
+	defer d.markStopped()
+	d.mutex.Lock()
+	d.state = StateDisconnected
+	client := d.client
+	topics := make([]string, 0, len(d.subscriptions))
+	for _, s := range d.subscriptions {
+		topics = append(topics, s.topic)
+	}
+	d.subscriptions = nil
+	d.mutex.Unlock()
+	if client == nil || !client.IsConnected() {
+		return nil
+	}
+	var tokens []mqtt.Token
+	if !wipe {
+		tokens = append(tokens, client.Publish(d.Topic("$state"), 1, true, StateDisconnected))
+	}
+	if len(topics) > 0 {
+		tokens = append(tokens, client.Unsubscribe(topics...))
+	}
+	defer d.setBroker(d.Stats().Broker(), false)
+	for _, token := range tokens {
+		if err := mqttutil.WaitToken(ctx, token); err != nil {
+			client.Disconnect(0)
+			return err
+		}
+	}
+	if wipe {
+		if err := WipeDevice(ctx, client, d.config.BaseTopic, d.name, d.Description()); err != nil {
+			client.Disconnect(0)
+			return err
+		}
+		d.mutex.Lock()
+		handler := d.wipeHandler
+		d.mutex.Unlock()
+		if handler != nil {
+			if err := handler(ctx, d); err != nil {
+				client.Disconnect(0)
+				return err
+			}
+		}
+	}
+	client.Disconnect(250)
+	return nil
+}
+
+func (d *device) markStopped() {
+	select {
+	case <-d.stopped:
+	default:
+		close(d.stopped)
+	}
+}
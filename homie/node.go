@@ -1,90 +1,256 @@
 package homie
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sort"
 	"strings"
+	"sync"
 )
 
 // Node homie node type
 type Node interface {
+	// Name node ID, used in topics
 	Name() string
+	// FriendlyName human readable name, published as $name, defaults to Name()
+	FriendlyName() string
+	SetFriendlyName(name string) Node
 	Type() string
 	Device() Device
 	SetDevice(d Device) Node
 
-	NewProperty(name string, propertyType string) Property
-	AddProperty(p Property) Property
+	// NewProperty create and add a property, propertyType must be a Homie datatype or empty for string
+	NewProperty(name string, propertyType string) (Property, error)
+	// AddProperty add a property, if device is connected property is subscribed and published and $properties is republished
+	AddProperty(p Property) (Property, error)
+	// RemoveProperty remove a property, its /set topic is unsubscribed and its retained topics are cleared
+	RemoveProperty(name string) error
 	GetProperty(name string) Property
 	// return sorted slice of node properties
 	PropertyNames() []string
 
+	// Retained default retained flag of node properties, defaults to device setting
+	Retained() bool
+	SetRetained(retained bool) Node
+	// QoS default QoS of node properties, defaults to device setting
+	QoS() byte
+	// SetQoS set default QoS of node properties, qos must be 0, 1 or 2
+	SetQoS(qos byte) Node
+
 	NodePublisher() NodePublisher
 	SetNodePublisher(publisher NodePublisher) Node
 
-	// NodeTopic returns relative topic name for a part, for example timeNode/currentTime
+	// NodeTopic returns relative topic name for a part, for example time/current-time
 	NodeTopic(part string) string
 
+	// Publish send current value of all node properties
 	Publish() Node
+	// PublishContext send current value of all node properties and wait until they are delivered,
+	// returns first delivery error, see Device.SendMessageContext
+	PublishContext(ctx context.Context) error
+	// PublishAttributes send node attributes ($name, $type, $properties) and attributes of all node properties
+	PublishAttributes() Node
 	// Subscribe subscribe node properties
 	Subscribe() Node
 }
 
 type node struct {
-	id         string
-	name       string
-	nodeType   string
-	device     Device
-	properties map[string]Property
-	publisher  NodePublisher
+	name         string
+	friendlyName string
+	nodeType     string
+	device       Device
+	properties   map[string]Property
+	publisher    NodePublisher
+	retained     *bool // nil to use device setting
+	qos          *byte // nil to use device setting
+
+	mutex sync.RWMutex
+}
+
+// NewNode create a node which is not added to a device yet, its properties can be added and configured
+// before it is added with Device.AddNode, for example to publish it at runtime with all attributes at once
+func NewNode(name string, nodeType string) Node {
+	return &node{
+		name:     name,
+		nodeType: nodeType,
+	}
 }
 
 func (n *node) Name() string {
 	return n.name
 }
+func (n *node) FriendlyName() string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	if n.friendlyName == "" {
+		return n.name
+	}
+	return n.friendlyName
+}
+func (n *node) SetFriendlyName(name string) Node {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.friendlyName = name
+	return n
+}
 func (n *node) Type() string {
 	return n.nodeType
 }
 func (n *node) Device() Device {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
 	return n.device
 }
 func (n *node) SetDevice(d Device) Node {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
 	n.device = d
 	return n
 }
+func (n *node) Retained() bool {
+	n.mutex.RLock()
+	retained, d := n.retained, n.device
+	n.mutex.RUnlock()
+	if retained != nil {
+		return *retained
+	}
+	if d != nil {
+		return d.Retained()
+	}
+	return true
+}
+func (n *node) SetRetained(retained bool) Node {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.retained = &retained
+	return n
+}
+func (n *node) QoS() byte {
+	n.mutex.RLock()
+	qos, d := n.qos, n.device
+	n.mutex.RUnlock()
+	if qos != nil {
+		return *qos
+	}
+	if d != nil {
+		return d.QoS()
+	}
+	return defaultQoS
+}
+func (n *node) SetQoS(qos byte) Node {
+	if !isValidQoS(qos) {
+		log.Printf("Invalid QoS %d of node: %s is ignored", qos, n.name)
+		return n
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.qos = &qos
+	return n
+}
 func (n *node) NodePublisher() NodePublisher {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
 	return n.publisher
 }
 func (n *node) SetNodePublisher(publisher NodePublisher) Node {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
 	n.publisher = publisher
 	return n
 }
 
 func (n *node) GetProperty(name string) Property {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
 	return n.properties[name]
 }
 
-func (n *node) NewProperty(name string, propertyType string) Property {
+func (n *node) NewProperty(name string, propertyType string) (Property, error) {
+	if propertyType != "" && !IsValidDataType(propertyType) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDataType, propertyType)
+	}
 	return n.AddProperty(&property{
 		name:         name,
 		propertyType: propertyType,
 	})
 }
 
-func (n *node) AddProperty(p Property) Property {
-	p.SetNode(n)
+func (n *node) AddProperty(p Property) (Property, error) {
+	if !IsValidID(p.Name()) {
+		return nil, fmt.Errorf("%w: property %q, node: %s", ErrInvalidID, p.Name(), n.name)
+	}
+	n.mutex.Lock()
 	if n.properties == nil {
 		n.properties = make(map[string]Property)
 	}
 	if _, alreadyAdded := n.properties[p.Name()]; alreadyAdded {
-		log.Panic(fmt.Errorf("Property %s already added to node: %s", p.Name(), n.name))
+		n.mutex.Unlock()
+		return nil, fmt.Errorf("%w: %s, node: %s", ErrDuplicateProperty, p.Name(), n.name)
 	}
+	p.SetNode(n)
 	n.properties[p.Name()] = p
-	return p
+	d := n.device
+	n.mutex.Unlock()
+
+	if d == nil {
+		return p, nil
+	}
+	n.reconfigure(d, func() {
+		p.Subscribe()
+		if !d.Config().isVersion5() {
+			p.PublishAttributes()
+		}
+		p.Publish()
+	})
+	return p, nil
+}
+
+func (n *node) RemoveProperty(name string) error {
+	n.mutex.Lock()
+	p, ok := n.properties[name]
+	delete(n.properties, name)
+	d := n.device
+	n.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s, node: %s", ErrPropertyNotFound, name, n.name)
+	}
+	if d == nil {
+		return nil
+	}
+	d.Unsubscribe(n.NodeTopic(name + "/set"))
+	r, ok := d.(reconfigurer)
+	if !ok || d.GetNode(n.name) != Node(n) {
+		return nil
+	}
+	clear := func() {
+		r.clearProperty(n, p)
+	}
+	if !n.reconfigure(d, clear) {
+		// topics are cleared on next connect
+		clear()
+	}
+	return nil
+}
+
+// reconfigure apply a property change via device, change is called only if node is not removed from device,
+// $properties is republished in Homie 3/4. Returns false if change is not applied
+func (n *node) reconfigure(d Device, change func()) bool {
+	r, ok := d.(reconfigurer)
+	if !ok || d.GetNode(n.name) != Node(n) {
+		return false
+	}
+	return r.reconfigure(func() {
+		change()
+		if !d.Config().isVersion5() {
+			d.SendMessage(n.NodeTopic("$properties"), strings.Join(n.PropertyNames(), ","))
+		}
+	})
 }
 
 func (n *node) PropertyNames() []string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
 	names := make([]string, 0, len(n.properties))
 	for name := range n.properties {
 		names = append(names, name)
@@ -98,22 +264,37 @@ func (n *node) NodeTopic(part string) string {
 }
 
 func (n *node) Subscribe() Node {
-	for _, p := range n.properties {
-		p.Subscribe()
+	for _, name := range n.PropertyNames() {
+		n.GetProperty(name).Subscribe()
 	}
 	return n
 }
 
 func (n *node) Publish() Node {
-	n.device.SendMessage(n.NodeTopic("$name"), n.name)
-	n.device.SendMessage(n.NodeTopic("$type"), n.nodeType)
-	var propNames []string
-	for _, p := range n.properties {
-		propNames = append(propNames, p.Name())
-	}
-	n.Device().SendMessage(n.NodeTopic("$properties"), strings.Join(propNames, ","))
-	for _, p := range n.properties {
-		p.Publish()
+	for _, name := range n.PropertyNames() {
+		n.GetProperty(name).Publish()
+	}
+	return n
+}
+
+func (n *node) PublishContext(ctx context.Context) error {
+	var result error
+	for _, name := range n.PropertyNames() {
+		if err := n.GetProperty(name).PublishContext(ctx); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func (n *node) PublishAttributes() Node {
+	d := n.Device()
+	names := n.PropertyNames()
+	d.SendMessage(n.NodeTopic("$name"), n.FriendlyName())
+	d.SendMessage(n.NodeTopic("$type"), n.nodeType)
+	d.SendMessage(n.NodeTopic("$properties"), strings.Join(names, ","))
+	for _, name := range names {
+		n.GetProperty(name).PublishAttributes()
 	}
 	return n
 }
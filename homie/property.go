@@ -1,92 +1,363 @@
 package homie
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"strconv"
+	"sync"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 // Property homie node property
 type Property interface {
+	// Name property ID, used in topics
 	Name() string
+	// FriendlyName human readable name, published as $name, defaults to Name()
+	FriendlyName() string
+	SetFriendlyName(name string) Property
+	// Type property datatype, published as $datatype, defaults to "string"
 	Type() string
+	SetType(propertyType string) Property
+	Unit() string
+	SetUnit(unit string) Property
+	Format() string
+	SetFormat(format string) Property
+	// Retained whether property value is retained by broker, published as $retained, defaults to node setting
+	Retained() bool
+	SetRetained(retained bool) Property
+	// QoS MQTT QoS of value publishes and /set subscription, defaults to node setting
+	QoS() byte
+	// SetQoS set QoS, qos must be 0, 1 or 2, it should be set before device is connected
+	SetQoS(qos byte) Property
+	// Settable a property is settable if it has a Handler
+	Settable() bool
+	// Validate check a value against property datatype and format
+	Validate(value string) error
+	// Target Homie 5 target value, the value a property is moving towards after a set command
+	Target() string
+	SetTarget(target string) Property
+	// PublishTarget send target value to device/node/prop/$target, it is called on valid set commands in Homie 5
+	PublishTarget() Property
 	Value() string
+	// SetValue set current value, values of persistent properties are saved to config.Store
 	SetValue(value string) Property
+	// Persistent whether property value is saved to config.Store, defaults to false
+	Persistent() bool
+	// SetPersistent mark property as persistent, empty value is restored from config.Store
+	SetPersistent(persistent bool) Property
 	Node() Node
 	SetNode(n Node) Property
-	// Publish send current value as MQTT payload, topic will be Node().Topic(Name())
+	// Publish send current value as MQTT payload, topic will be Node().Topic(Name()), retained if Retained() is true
 	Publish() Property
+	// PublishContext send current value and wait until it is delivered, see Device.SendMessageContext
+	PublishContext(ctx context.Context) error
+	// PublishAttributes send property attributes: $name, $datatype, $settable, $retained and optional $unit, $format
+	PublishAttributes() Property
 
 	// Subscribe called during initialisation, subscribe to MQTT topic: device/node/prop/set if property Handler is set
 	Subscribe() Property
 
 	Handler() PropertyHandler
 	// SetHandler set handler for incomming MQTT messages, by setting Handler, the property will be settable (topic: device/node/prop/set)
+	// payloads are validated against property datatype and format before calling the handler,
+	// if device is connected /set topic is subscribed (or unsubscribed for nil handler) and $settable is republished
 	SetHandler(h PropertyHandler) Property
 }
 
 type property struct {
 	name         string
+	friendlyName string
 	propertyType string
+	unit         string
+	format       string
+	retained     *bool // nil to use node setting
+	qos          *byte // nil to use node setting
+	persistent   bool
 	value        string
+	target       string
 	handler      PropertyHandler // if set, the property will be settable
 	node         Node
+
+	mutex sync.RWMutex
 }
 
 func (p *property) Name() string {
 	return p.name
 }
 
+func (p *property) FriendlyName() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.friendlyName == "" {
+		return p.name
+	}
+	return p.friendlyName
+}
+
+func (p *property) SetFriendlyName(name string) Property {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.friendlyName = name
+	return p
+}
+
 func (p *property) Type() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.propertyType == "" {
+		return "string"
+	}
 	return p.propertyType
 }
 
+func (p *property) SetType(propertyType string) Property {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.propertyType = propertyType
+	return p
+}
+
+func (p *property) Unit() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.unit
+}
+
+func (p *property) SetUnit(unit string) Property {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.unit = unit
+	return p
+}
+
+func (p *property) Format() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.format
+}
+
+func (p *property) SetFormat(format string) Property {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.format = format
+	return p
+}
+
+func (p *property) Retained() bool {
+	p.mutex.RLock()
+	retained, n := p.retained, p.node
+	p.mutex.RUnlock()
+	if retained != nil {
+		return *retained
+	}
+	if n != nil {
+		return n.Retained()
+	}
+	return true
+}
+
+func (p *property) SetRetained(retained bool) Property {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.retained = &retained
+	return p
+}
+
+func (p *property) QoS() byte {
+	p.mutex.RLock()
+	qos, n := p.qos, p.node
+	p.mutex.RUnlock()
+	if qos != nil {
+		return *qos
+	}
+	if n != nil {
+		return n.QoS()
+	}
+	return defaultQoS
+}
+
+func (p *property) SetQoS(qos byte) Property {
+	if !isValidQoS(qos) {
+		log.Printf("Invalid QoS %d of property: %s is ignored", qos, p.name)
+		return p
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.qos = &qos
+	return p
+}
+
+func (p *property) Settable() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.handler != nil
+}
+
 func (p *property) Value() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
 	return p.value
 }
 
 func (p *property) SetValue(value string) Property {
+	p.mutex.Lock()
 	p.value = value
+	persistent := p.persistent
+	p.mutex.Unlock()
+	if !persistent {
+		return p
+	}
+	if store := p.store(); store != nil {
+		if err := store.Save(storeKey(p), value); err != nil {
+			log.Printf("Failed to save value of property: %s, %v", p.name, err)
+		}
+	}
+	return p
+}
+
+func (p *property) Persistent() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.persistent
+}
+
+func (p *property) SetPersistent(persistent bool) Property {
+	p.mutex.Lock()
+	p.persistent = persistent
+	p.mutex.Unlock()
+	if store := p.store(); persistent && store != nil {
+		loadStoredValue(store, p)
+	}
+	return p
+}
+
+// store returns state store of device, nil if property is not added to a device or device has no store
+func (p *property) store() StateStore {
+	n := p.Node()
+	if n == nil || n.Device() == nil {
+		return nil
+	}
+	return n.Device().Config().Store
+}
+
+func (p *property) Target() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.target
+}
+
+func (p *property) SetTarget(target string) Property {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.target = target
+	return p
+}
+
+func (p *property) PublishTarget() Property {
+	p.Node().Device().SendMessageWithOptions(p.attributeTopic("$target"), p.Target(), p.QoS(), p.Retained())
 	return p
 }
 
 func (p *property) Node() Node {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
 	return p.node
 }
 
 func (p *property) SetNode(n Node) Property {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 	p.node = n
 	return p
 }
 func (p *property) Handler() PropertyHandler {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
 	return p.handler
 }
 func (p *property) SetHandler(h PropertyHandler) Property {
+	p.mutex.Lock()
 	p.handler = h
+	n := p.node
+	p.mutex.Unlock()
+
+	// property is already added, subscribe or unsubscribe /set and republish $settable
+	if n == nil || n.Device() == nil {
+		return p
+	}
+	d := n.Device()
+	if h == nil {
+		d.Unsubscribe(p.attributeTopic("set"))
+	}
+	if r, ok := d.(reconfigurer); ok && d.GetNode(n.Name()) == n && n.GetProperty(p.name) == Property(p) {
+		r.reconfigure(func() {
+			p.Subscribe()
+			if !d.Config().isVersion5() {
+				d.SendMessage(p.attributeTopic("$settable"), strconv.FormatBool(h != nil))
+			}
+		})
+	}
 	return p
 }
 
 func (p *property) Publish() Property {
-	p.node.Device().SendMessage(p.Node().NodeTopic(p.name), p.value)
+	p.Node().Device().SendMessageWithOptions(p.Node().NodeTopic(p.name), p.Value(), p.QoS(), p.Retained())
+	return p
+}
+
+func (p *property) PublishContext(ctx context.Context) error {
+	return p.Node().Device().SendMessageContext(ctx, p.Node().NodeTopic(p.name), p.Value(), p.QoS(), p.Retained())
+}
+
+func (p *property) Validate(value string) error {
+	return ValidateValue(p.Type(), p.Format(), value)
+}
+
+func (p *property) PublishAttributes() Property {
+	d := p.Node().Device()
+	d.SendMessage(p.attributeTopic("$name"), p.FriendlyName())
+	d.SendMessage(p.attributeTopic("$datatype"), p.Type())
+	d.SendMessage(p.attributeTopic("$settable"), strconv.FormatBool(p.Settable()))
+	d.SendMessage(p.attributeTopic("$retained"), strconv.FormatBool(p.Retained()))
+	if unit := p.Unit(); unit != "" {
+		d.SendMessage(p.attributeTopic("$unit"), unit)
+	}
+	if format := p.Format(); format != "" {
+		d.SendMessage(p.attributeTopic("$format"), format)
+	}
 	return p
 }
 
+func (p *property) attributeTopic(attribute string) string {
+	return p.Node().NodeTopic(fmt.Sprintf("%s/%s", p.name, attribute))
+}
+
 func (p *property) Subscribe() Property {
 	if p.Handler() == nil {
 		return p
 	}
-	topic := p.Node().Device().Topic(p.Node().NodeTopic(fmt.Sprintf("%s/set", p.name)))
-	p.node.Device().Client().Subscribe(topic, 1, func(client mqtt.Client, message mqtt.Message) {
+	p.Node().Device().Subscribe(p.attributeTopic("set"), p.QoS(), func(client mqtt.Client, message mqtt.Message) {
 		p.onMessage(message.Topic(), message.Payload())
 	})
 	return p
 }
 
 func (p *property) onMessage(topic string, payload []byte) {
-	if p.Handler() == nil {
-		log.Fatalf("No handler for property: %s, topic: %s", p.name, topic)
+	handler := p.Handler()
+	if handler == nil {
+		log.Printf("No handler for property: %s, topic: %s", p.name, topic)
+		return
+	}
+	if err := p.Validate(string(payload)); err != nil {
+		log.Printf("Invalid payload for property: %s, topic: %s, %v", p.name, topic, err)
 		return
 	}
-	p.handler(p, payload, topic)
+	if p.Node().Device().Config().isVersion5() {
+		p.SetTarget(string(payload)).PublishTarget()
+	}
+	if _, err := handler(p, payload, topic); err != nil {
+		log.Printf("Handler of property: %s failed, topic: %s, %v", p.name, topic, err)
+	}
 }
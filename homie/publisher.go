@@ -13,10 +13,10 @@ type DevicePublisher func(d Device)
 
 // PeriodicPublisher periodically invoke configured publishers, can have multiple instances of PeriodicPublisher
 // for example, group some nodes to publish properties every minutes and some other nodes to publish every hour
-// device can have only one publisher, if multiple PeriodicPublisher configured for a device, there will be a panic
+// device can have only one publisher, if multiple PeriodicPublisher configured for a device, ErrPublisherConfigured is returned
 type PeriodicPublisher interface {
 	GetDevicePublisher() DevicePublisher
-	SetDevicePublisher(d Device, publisher DevicePublisher) PeriodicPublisher
+	SetDevicePublisher(d Device, publisher DevicePublisher) (PeriodicPublisher, error)
 	GetNodePublisher(node Node) NodePublisher
 	AddNodePublisher(node Node, publisher NodePublisher) PeriodicPublisher
 	Start()
@@ -27,6 +27,7 @@ type periodicPublisher struct {
 	devicePublisher DevicePublisher
 	device          Device
 	nodePublishers  map[Node]NodePublisher
+	period          time.Duration
 	ticker          *time.Ticker
 	done            chan bool
 	started         bool
@@ -34,20 +35,35 @@ type periodicPublisher struct {
 }
 
 func (p *periodicPublisher) GetDevicePublisher() DevicePublisher {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 	return p.devicePublisher
 }
 
-func (p *periodicPublisher) SetDevicePublisher(d Device, publisher DevicePublisher) PeriodicPublisher {
-	p.devicePublisher = publisher
-	p.device = d
-	p.device.SetDevicePublisher(func(d Device) {
+func (p *periodicPublisher) SetDevicePublisher(d Device, publisher DevicePublisher) (PeriodicPublisher, error) {
+	err := d.SetDevicePublisher(func(d Device) {
 		p.Start()
 	})
-	return p
+	if err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	p.devicePublisher = publisher
+	p.device = d
+	p.mutex.Unlock()
+	if r, ok := d.(publisherRegistry); ok {
+		r.registerPublisher(p)
+	}
+	return p, nil
 }
 
 func (p *periodicPublisher) AddNodePublisher(node Node, publisher NodePublisher) PeriodicPublisher {
+	p.mutex.Lock()
 	p.nodePublishers[node] = publisher
+	p.mutex.Unlock()
+	if r, ok := node.Device().(publisherRegistry); ok {
+		r.registerPublisher(p)
+	}
 	node.SetNodePublisher(func(n Node) {
 		p.Start()
 	})
@@ -55,33 +71,46 @@ func (p *periodicPublisher) AddNodePublisher(node Node, publisher NodePublisher)
 }
 
 func (p *periodicPublisher) GetNodePublisher(node Node) NodePublisher {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 	return p.nodePublishers[node]
 }
 
 func (p *periodicPublisher) Start() {
 	p.mutex.Lock()
+	defer p.mutex.Unlock()
 	if p.started {
-		defer p.mutex.Unlock()
 		return
 	}
+	p.started = true
+	ticker := time.NewTicker(p.period)
+	done := make(chan bool)
+	p.ticker, p.done = ticker, done
 	go func() {
-		p.started = true
-		p.mutex.Unlock()
 		for {
 			select {
-			case <-p.done:
+			case <-done:
 				return
-			case <-p.ticker.C:
+			case <-ticker.C:
 				p.invokePublishers()
 			}
 		}
 	}()
 }
+
+// invokePublishers call publishers outside of the lock, publishers may add node publishers
 func (p *periodicPublisher) invokePublishers() {
-	if p.devicePublisher != nil {
-		p.devicePublisher(p.device)
-	}
+	p.mutex.Lock()
+	device, devicePublisher := p.device, p.devicePublisher
+	nodePublishers := make(map[Node]NodePublisher, len(p.nodePublishers))
 	for node, nodePublisher := range p.nodePublishers {
+		nodePublishers[node] = nodePublisher
+	}
+	p.mutex.Unlock()
+	if devicePublisher != nil {
+		devicePublisher(device)
+	}
+	for node, nodePublisher := range nodePublishers {
 		nodePublisher(node)
 	}
 }
@@ -89,9 +118,11 @@ func (p *periodicPublisher) invokePublishers() {
 func (p *periodicPublisher) Close() {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
+	if !p.started {
+		return
+	}
 	p.ticker.Stop()
-	// used a goroutine to avoid blocking in case of publisher routine is crashed or so
-	go func() { p.done <- true }()
+	close(p.done)
 	p.started = false
 }
 
@@ -99,18 +130,15 @@ func (p *periodicPublisher) Close() {
 func NewPeriodicPublisher(period time.Duration) PeriodicPublisher {
 	return &periodicPublisher{
 		nodePublishers: make(map[Node]NodePublisher),
-		done:           make(chan bool),
-		ticker:         time.NewTicker(period),
-		started:        false,
+		period:         period,
 		mutex:          &sync.Mutex{},
 	}
 }
 
 // NewDevicePublisher create default device publisher to publish device stats (uptime)
-func NewDevicePublisher(d Device) PeriodicPublisher {
+func NewDevicePublisher(d Device) (PeriodicPublisher, error) {
 	p := NewPeriodicPublisher(time.Duration(d.Config().StatsReportInterval) * time.Second)
-	p.SetDevicePublisher(d, func(d Device) {
+	return p.SetDevicePublisher(d, func(d Device) {
 		d.PublishStats()
 	})
-	return p
 }
@@ -0,0 +1,133 @@
+package homie
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+// DropPolicy decides which message is dropped when publish queue is full
+type DropPolicy string
+
+// Drop policies of publish queue
+const (
+	DropOldest DropPolicy = "oldest" // drop the oldest queued message, default
+	DropNewest DropPolicy = "newest" // drop the new message
+)
+
+// QueueConfig publish queue config, messages sent while device is disconnected are queued and flushed in order on connect
+type QueueConfig struct {
+	Size       int        // max queued messages, 0 disables the queue and messages are dropped while disconnected
+	DropPolicy DropPolicy // DropOldest (default) or DropNewest
+	Path       string     // optional file to persist queued messages, they are flushed after restart
+}
+
+// queuedMessage a message waiting for connection, topic is full topic
+type queuedMessage struct {
+	Topic    string `json:"topic"`
+	Payload  string `json:"payload"`
+	QoS      byte   `json:"qos"`
+	Retained bool   `json:"retained"`
+}
+
+// publishQueue bounded queue of outgoing messages, only the latest retained message of a topic is kept
+type publishQueue struct {
+	config   QueueConfig
+	messages []queuedMessage
+	dropped  uint64
+	mutex    sync.Mutex
+}
+
+// newPublishQueue create a queue, returns nil if queue is disabled, queued messages are loaded from config.Path
+func newPublishQueue(config QueueConfig) (*publishQueue, error) {
+	if config.Size <= 0 {
+		return nil, nil
+	}
+	q := &publishQueue{config: config}
+	if config.Path == "" {
+		return q, nil
+	}
+	data, err := ioutil.ReadFile(config.Path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &q.messages); err != nil {
+		return nil, err
+	}
+	if len(q.messages) > config.Size {
+		q.messages = q.messages[len(q.messages)-config.Size:]
+	}
+	return q, nil
+}
+
+// push add a message, a queued retained message of the same topic is replaced
+func (q *publishQueue) push(m queuedMessage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if m.Retained {
+		for i := range q.messages {
+			if q.messages[i].Topic == m.Topic && q.messages[i].Retained {
+				q.messages = append(q.messages[:i], q.messages[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(q.messages) >= q.config.Size {
+		q.dropped++
+		if q.config.DropPolicy == DropNewest {
+			return
+		}
+		q.messages = q.messages[1:]
+	}
+	q.messages = append(q.messages, m)
+	q.save()
+}
+
+// drain remove and return all queued messages
+func (q *publishQueue) drain() []queuedMessage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	messages := q.messages
+	q.messages = nil
+	if len(messages) > 0 {
+		q.save()
+	}
+	return messages
+}
+
+func (q *publishQueue) depth() int {
+	if q == nil {
+		return 0
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.messages)
+}
+
+func (q *publishQueue) droppedCount() uint64 {
+	if q == nil {
+		return 0
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.dropped
+}
+
+// save write queued messages to config.Path, called with lock held
+func (q *publishQueue) save() {
+	if q.config.Path == "" {
+		return
+	}
+	data, err := json.Marshal(q.messages)
+	if err == nil {
+		err = writeFileAtomic(q.config.Path, data)
+	}
+	if err != nil {
+		log.Printf("Failed to save publish queue to %s: %v", q.config.Path, err)
+	}
+}
@@ -0,0 +1,136 @@
+package homie
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/masgari/homie-go/internal/mqttutil"
+)
+
+// retainedSettleTime time to wait for more retained messages of a device after the last one
+const retainedSettleTime = 300 * time.Millisecond
+
+// retainedTimeout max wait to read and clean up retained topics on connect
+const retainedTimeout = 10 * time.Second
+
+// loadRetained read retained device topics on first connect, restore property values and clear stale topics if enabled
+func (d *device) loadRetained() error {
+	if !d.config.RestoreValues && !d.config.CleanupStaleTopics {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), retainedTimeout)
+	defer cancel()
+	retained, err := retainedMessages(ctx, d.Client(), d.Topic("#"))
+	if err != nil {
+		return err
+	}
+	if d.config.RestoreValues {
+		d.restoreValues(retained)
+	}
+	if d.config.CleanupStaleTopics {
+		return d.cleanupStaleTopics(ctx, retained)
+	}
+	return nil
+}
+
+// restoreValues set empty values of retained properties from retained messages,
+// if config.RestoreCallsHandlers is true handlers of settable properties are called to re-apply the values
+func (d *device) restoreValues(retained map[string][]byte) {
+	for _, nodeName := range d.NodeNames() {
+		n := d.GetNode(nodeName)
+		for _, propName := range n.PropertyNames() {
+			p := n.GetProperty(propName)
+			topic := d.Topic(n.NodeTopic(propName))
+			payload, ok := retained[topic]
+			if !ok || !p.Retained() || p.Value() != "" {
+				continue
+			}
+			if err := p.Validate(string(payload)); err != nil {
+				log.Printf("Retained value of property: %s is not restored, topic: %s, %v", propName, topic, err)
+				continue
+			}
+			p.SetValue(string(payload))
+			handler := p.Handler()
+			if !d.config.RestoreCallsHandlers || handler == nil {
+				continue
+			}
+			if _, err := handler(p, payload, topic); err != nil {
+				log.Printf("Handler of property: %s failed to restore value, topic: %s, %v", propName, topic, err)
+			}
+		}
+	}
+}
+
+// cleanupStaleTopics clear retained device topics which are not part of current nodes and properties,
+// for example topics of nodes removed in a new version of device
+func (d *device) cleanupStaleTopics(ctx context.Context, retained map[string][]byte) error {
+	client := d.Client()
+	known := make(map[string]bool)
+	for _, part := range descriptionTopics(d.Description()) {
+		known[d.Topic(part)] = true
+	}
+	var tokens []mqtt.Token
+	for topic := range retained {
+		if !known[topic] {
+			log.Printf("Clearing stale topic of device %s: %s", d.name, topic)
+			tokens = append(tokens, client.Publish(topic, 1, true, ""))
+		}
+	}
+	for _, token := range tokens {
+		if err := mqttutil.WaitToken(ctx, token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retainedMessages subscribe to filter and collect retained messages by topic,
+// it returns when no retained message is received for retainedSettleTime
+func retainedMessages(ctx context.Context, client MqttAdapter, filter string) (map[string][]byte, error) {
+	var mutex sync.Mutex
+	messages := make(map[string][]byte)
+	received := make(chan struct{}, 1)
+	token := client.Subscribe(filter, 1, func(c mqtt.Client, message mqtt.Message) {
+		if !message.Retained() || len(message.Payload()) == 0 {
+			return
+		}
+		mutex.Lock()
+		messages[message.Topic()] = message.Payload()
+		mutex.Unlock()
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+	})
+	if err := mqttutil.WaitToken(ctx, token); err != nil {
+		return nil, err
+	}
+	defer client.Unsubscribe(filter)
+
+	timer := time.NewTimer(retainedSettleTime)
+	defer timer.Stop()
+	for settled := false; !settled; {
+		select {
+		case <-received:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(retainedSettleTime)
+		case <-timer.C:
+			settled = true
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	result := make(map[string][]byte, len(messages))
+	for topic, payload := range messages {
+		result[topic] = payload
+	}
+	return result, nil
+}
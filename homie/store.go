@@ -0,0 +1,167 @@
+package homie
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// StateStore persists values of persistent properties, keys are device ID and relative property topic,
+// for example device/node/property, so a store can be shared by devices
+type StateStore interface {
+	// Load returns stored value of a key, ok is false if key is not stored
+	Load(key string) (value string, ok bool, err error)
+	Save(key string, value string) error
+	Close() error
+}
+
+// loadStoredValue set value of a persistent property from store if it has no value
+func loadStoredValue(store StateStore, p Property) {
+	if p.Value() != "" {
+		return
+	}
+	value, ok, err := store.Load(storeKey(p))
+	if err != nil {
+		log.Printf("Failed to load value of property: %s, %v", p.Name(), err)
+		return
+	}
+	if ok {
+		p.SetValue(value)
+	}
+}
+
+// storeKey returns key of a property value in StateStore
+func storeKey(p Property) string {
+	return p.Node().Device().Name() + "/" + p.Node().NodeTopic(p.Name())
+}
+
+// restoreStoredValues load values of persistent properties from config.Store
+func (d *device) restoreStoredValues() {
+	if d.config.Store == nil {
+		return
+	}
+	for _, nodeName := range d.NodeNames() {
+		n := d.GetNode(nodeName)
+		for _, propName := range n.PropertyNames() {
+			if p := n.GetProperty(propName); p.Persistent() {
+				loadStoredValue(d.config.Store, p)
+			}
+		}
+	}
+}
+
+// fileStore keeps all values in a JSON file, the file is rewritten on each Save
+type fileStore struct {
+	path   string
+	values map[string]string
+	mutex  sync.Mutex
+}
+
+// NewFileStore create a StateStore backed by a JSON file, the file is created on first Save
+func NewFileStore(path string) (StateStore, error) {
+	s := &fileStore{path: path, values: make(map[string]string)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.values); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileStore) Load(key string) (string, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok := s.values[key]
+	return value, ok, nil
+}
+
+func (s *fileStore) Save(key string, value string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if current, ok := s.values[key]; ok && current == value {
+		return nil
+	}
+	s.values[key] = value
+	data, err := json.MarshalIndent(s.values, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic write to a temporary file and rename it, to not lose the file on a crash
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+// boltBucket bucket of property values in bolt database
+var boltBucket = []byte("values")
+
+// boltStore keeps values in an embedded bolt key-value database
+type boltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore create a StateStore backed by a bolt database file, Close must be called to release the file
+func NewBoltStore(path string) (StateStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Load(key string) (value string, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltBucket).Get([]byte(key)); v != nil {
+			value, ok = string(v), true
+		}
+		return nil
+	})
+	return value, ok, err
+}
+
+func (s *boltStore) Save(key string, value string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), []byte(value))
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -1,16 +1,15 @@
 package homie
 
 import (
-	"log"
 	"net"
 )
 
-func outboundIP() string {
+func outboundIP() (string, error) {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 	defer conn.Close()
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP.String()
+	return localAddr.IP.String(), nil
 }
@@ -0,0 +1,82 @@
+package homie
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/masgari/homie-go/internal/mqttutil"
+)
+
+// deviceAttributes device topics published by any Homie version
+var deviceAttributes = []string{
+	"$state", "$homie", "$name", "$nodes", "$extensions", "$description",
+	"$localip", "$implementation", "$stats/interval", "$stats/uptime",
+}
+
+// WipeDevice clear all retained topics of a device by publishing empty retained payloads,
+// topics are taken from desc (can be nil) and from retained messages found under <baseTopic>/<deviceID>/#.
+// desc.Homie is used to find device topic, Homie 5 devices are under <baseTopic>/5/<deviceID>/
+func WipeDevice(ctx context.Context, client MqttAdapter, baseTopic string, deviceID string, desc *Description) error {
+	if client == nil || !client.IsConnected() {
+		return fmt.Errorf("%w: wipe device %s", ErrNotConnected, deviceID)
+	}
+	prefix := fmt.Sprintf("%s%s/", baseTopic, deviceID)
+	if desc != nil && strings.HasPrefix(desc.Homie, "5") {
+		prefix = fmt.Sprintf("%s5/%s/", baseTopic, deviceID)
+	}
+
+	topics := make(map[string]bool)
+	for _, part := range descriptionTopics(desc) {
+		topics[prefix+part] = true
+	}
+	retained, err := retainedMessages(ctx, client, prefix+"#")
+	if err != nil {
+		return err
+	}
+	for topic := range retained {
+		topics[topic] = true
+	}
+
+	sorted := make([]string, 0, len(topics))
+	for topic := range topics {
+		sorted = append(sorted, topic)
+	}
+	sort.Strings(sorted)
+	tokens := make([]mqtt.Token, 0, len(sorted))
+	for _, topic := range sorted {
+		tokens = append(tokens, client.Publish(topic, 1, true, ""))
+	}
+	for _, token := range tokens {
+		if err := mqttutil.WaitToken(ctx, token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// descriptionTopics returns relative topics of device, node and property attributes and property values
+func descriptionTopics(desc *Description) []string {
+	if desc == nil {
+		return nil
+	}
+	topics := append([]string(nil), deviceAttributes...)
+	for nodeName, node := range desc.Nodes {
+		topics = append(topics, nodeName+"/$name", nodeName+"/$type", nodeName+"/$properties")
+		for propName, prop := range node.Properties {
+			topics = append(topics, nodeName+"/"+propName)
+			for _, attribute := range []string{"$name", "$datatype", "$settable", "$retained", "$target"} {
+				topics = append(topics, nodeName+"/"+propName+"/"+attribute)
+			}
+			if prop.Unit != "" {
+				topics = append(topics, nodeName+"/"+propName+"/$unit")
+			}
+			if prop.Format != "" {
+				topics = append(topics, nodeName+"/"+propName+"/$format")
+			}
+		}
+	}
+	return topics
+}
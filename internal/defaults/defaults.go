@@ -0,0 +1,10 @@
+// Package defaults provides default values of optional settings and attributes shared by packages
+package defaults
+
+// String returns value, or defaultValue if value is empty
+func String(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,302 @@
+// Package mqtttest provides a minimal in-memory MQTT 3.1.1 broker for tests
+package mqtttest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Broker in-memory MQTT broker, supports retained messages, wills, subscriptions of persistent sessions
+// and QoS 0-2 publishes from clients, messages are delivered to subscribers with QoS 0
+type Broker struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	clients  map[*client]bool
+	retained map[string][]byte
+	sessions map[string]map[string]bool // subscriptions of persistent sessions by client ID
+	closed   bool
+}
+
+type client struct {
+	conn          net.Conn
+	will          *packets.PublishPacket
+	subscriptions map[string]bool
+	writeMutex    sync.Mutex
+}
+
+// NewBroker start a broker on a random local port
+func NewBroker() (*Broker, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{
+		listener: listener,
+		clients:  make(map[*client]bool),
+		retained: make(map[string][]byte),
+		sessions: make(map[string]map[string]bool),
+	}
+	go b.accept()
+	return b, nil
+}
+
+// URL returns broker URL, for example tcp://127.0.0.1:1883
+func (b *Broker) URL() string {
+	return fmt.Sprintf("tcp://%s", b.listener.Addr().String())
+}
+
+// Close stop listening and drop all client connections
+func (b *Broker) Close() error {
+	b.mutex.Lock()
+	b.closed = true
+	b.mutex.Unlock()
+	err := b.listener.Close()
+	b.DropClients()
+	return err
+}
+
+// DropClients close all client connections, client wills are published
+func (b *Broker) DropClients() {
+	b.mutex.Lock()
+	clients := make([]*client, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.mutex.Unlock()
+	for _, c := range clients {
+		c.conn.Close()
+	}
+}
+
+// ClientCount returns number of connected clients
+func (b *Broker) ClientCount() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.clients)
+}
+
+// SubscriptionCount returns number of subscriptions of all clients
+func (b *Broker) SubscriptionCount() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	count := 0
+	for c := range b.clients {
+		count += len(c.subscriptions)
+	}
+	return count
+}
+
+// Retained returns retained message of a topic
+func (b *Broker) Retained(topic string) ([]byte, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	payload, ok := b.retained[topic]
+	return payload, ok
+}
+
+// WaitRetained wait until retained message of a topic is payload, returns false on timeout
+func (b *Broker) WaitRetained(topic string, payload string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if retained, _ := b.Retained(topic); string(retained) == payload {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// RetainedTopics returns topics with a retained message matching filter
+func (b *Broker) RetainedTopics(filter string) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var topics []string
+	for topic := range b.retained {
+		if Match(filter, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// Publish publish a message as if it is sent by a client
+func (b *Broker) Publish(topic string, payload []byte, retained bool) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = payload
+	p.Retain = retained
+	b.route(p)
+}
+
+func (b *Broker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(&client{conn: conn, subscriptions: make(map[string]bool)})
+	}
+}
+
+func (b *Broker) serve(c *client) {
+	clean := false
+	defer func() {
+		c.conn.Close()
+		b.mutex.Lock()
+		delete(b.clients, c)
+		b.mutex.Unlock()
+		if !clean && c.will != nil {
+			b.route(c.will)
+		}
+	}()
+	for {
+		packet, err := packets.ReadPacket(c.conn)
+		if err != nil {
+			return
+		}
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			b.mutex.Lock()
+			if b.closed {
+				b.mutex.Unlock()
+				return
+			}
+			b.clients[c] = true
+			ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			if p.CleanSession {
+				delete(b.sessions, p.ClientIdentifier)
+			} else if subscriptions, ok := b.sessions[p.ClientIdentifier]; ok {
+				c.subscriptions = subscriptions
+				ack.SessionPresent = true
+			} else {
+				b.sessions[p.ClientIdentifier] = c.subscriptions
+			}
+			b.mutex.Unlock()
+			if p.WillFlag {
+				will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				will.TopicName = p.WillTopic
+				will.Payload = p.WillMessage
+				will.Retain = p.WillRetain
+				c.will = will
+			}
+			c.write(ack)
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			b.mutex.Lock()
+			for _, topic := range p.Topics {
+				c.subscriptions[topic] = true
+				ack.ReturnCodes = append(ack.ReturnCodes, 0)
+			}
+			retained := make(map[string][]byte)
+			for topic, payload := range b.retained {
+				for _, filter := range p.Topics {
+					if Match(filter, topic) {
+						retained[topic] = payload
+					}
+				}
+			}
+			b.mutex.Unlock()
+			c.write(ack)
+			for topic, payload := range retained {
+				msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				msg.TopicName = topic
+				msg.Payload = payload
+				msg.Retain = true
+				c.write(msg)
+			}
+		case *packets.UnsubscribePacket:
+			b.mutex.Lock()
+			for _, topic := range p.Topics {
+				delete(c.subscriptions, topic)
+			}
+			b.mutex.Unlock()
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			c.write(ack)
+		case *packets.PublishPacket:
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				c.write(ack)
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				c.write(rec)
+			}
+			b.route(p)
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			c.write(comp)
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			clean = true
+			return
+		}
+	}
+}
+
+// route store retained message and deliver it to subscribers
+func (b *Broker) route(p *packets.PublishPacket) {
+	b.mutex.Lock()
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.TopicName)
+		} else {
+			b.retained[p.TopicName] = p.Payload
+		}
+	}
+	var subscribers []*client
+	for c := range b.clients {
+		for filter := range c.subscriptions {
+			if Match(filter, p.TopicName) {
+				subscribers = append(subscribers, c)
+				break
+			}
+		}
+	}
+	b.mutex.Unlock()
+	for _, c := range subscribers {
+		msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		msg.TopicName = p.TopicName
+		msg.Payload = p.Payload
+		c.write(msg)
+	}
+}
+
+func (c *client) write(p packets.ControlPacket) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	p.Write(c.conn)
+}
+
+// Match check if a topic matches a subscription filter with + and # wildcards
+func Match(filter string, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (filterParts[0] == "+" || filterParts[0] == "#") {
+		return false
+	}
+	for i, part := range filterParts {
+		if part == "#" {
+			return true
+		}
+		if i >= len(topicParts) {
+			return false
+		}
+		if part != "+" && part != topicParts[i] {
+			return false
+		}
+	}
+	return len(filterParts) == len(topicParts)
+}
@@ -0,0 +1,62 @@
+// Package mqttutil provides MQTT helpers shared by devices, the controller and the Home Assistant bridge
+package mqttutil
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// DefaultPublishTimeout max wait for delivery of a published message if it is not configured
+const DefaultPublishTimeout = 10 * time.Second
+
+// PublishTimeout returns timeout, DefaultPublishTimeout if it is not set
+func PublishTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return DefaultPublishTimeout
+	}
+	return timeout
+}
+
+// WaitToken wait for an MQTT token to complete or context to be done
+func WaitToken(ctx context.Context, token mqtt.Token) error {
+	done := make(chan struct{})
+	go func() {
+		token.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Retry call connect until it succeeds, ctx is done or maxAttempts attempts are failed (0 means no limit),
+// backoff returns wait time after a failed attempt and name is used in logs, for example "device living-room".
+// Returns ctx error or error of last attempt
+func Retry(ctx context.Context, name string, maxAttempts int, backoff func(attempt int) time.Duration, connect func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if maxAttempts > 0 && attempt >= maxAttempts {
+			return fmt.Errorf("after %d attempts: %v", attempt, err)
+		}
+		wait := backoff(attempt)
+		log.Printf("Failed to connect %s (attempt %d), retry in %s: %v", name, attempt, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}